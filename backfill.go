@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// backfillGatherer gathers all data points returned by the collector. Unlike
+// prometheus.Registry it allows multiple samples per series, as long as they
+// have different timestamps. Since the metrics describing the scrape have no
+// timestamp and aren't returned, an incomplete collection fails the gather.
+type backfillGatherer struct {
+	*collector
+}
+
+// Gather implements prometheus.Gatherer.
+func (g backfillGatherer) Gather() ([]*dto.MetricFamily, error) {
+	var (
+		ch       = make(chan prometheus.Metric)
+		families = make(map[string]*dto.MetricFamily)
+		firstErr error
+		complete = true
+	)
+	go func() {
+		g.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if m.Desc() == g.scrapeSuccessDesc && pb.GetGauge().GetValue() != 1 {
+			complete = false
+		}
+		g.descLock.Lock()
+		family, ok := g.families[m.Desc()]
+		g.descLock.Unlock()
+		// Skip metrics not representing data points, like aws_metrics_sent.
+		if !ok || pb.TimestampMs == nil {
+			continue
+		}
+		mf, ok := families[family.GetName()]
+		if !ok {
+			mf = &dto.MetricFamily{
+				Name: family.Name,
+				Help: family.Help,
+				Type: family.Type,
+			}
+			families[family.GetName()] = mf
+		}
+		mf.Metric = append(mf.Metric, pb)
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if !complete {
+		return nil, g.incompleteError()
+	}
+
+	mfs := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		// Samples of the same series need to be consecutive. The sort is
+		// stable to keep them in timestamp order.
+		sort.SliceStable(mf.Metric, func(i, j int) bool {
+			return labelsKey(mf.Metric[i]) < labelsKey(mf.Metric[j])
+		})
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool {
+		return mfs[i].GetName() < mfs[j].GetName()
+	})
+	return mfs, nil
+}
+
+// incompleteError returns the error for an incomplete collection.
+func (g backfillGatherer) incompleteError() error {
+	reasons := []string{}
+	if atomic.LoadUint32(&g.deadlineExceeded) == 1 {
+		reasons = append(reasons, "deadline exceeded")
+	}
+	g.batchErrorsLock.Lock()
+	for reason, n := range g.batchErrors {
+		reasons = append(reasons, fmt.Sprintf("%d batches failed with %s", n, reason))
+	}
+	g.batchErrorsLock.Unlock()
+	if len(reasons) == 0 {
+		reasons = append(reasons, "listing metrics failed")
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("incomplete collection: %s", strings.Join(reasons, ", "))
+}
+
+func labelsKey(m *dto.Metric) string {
+	parts := make([]string, len(m.Label))
+	for i, lp := range m.Label {
+		parts[i] = lp.GetName() + "=" + lp.GetValue()
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// serveBackfill writes all data points gathered by g in the OpenMetrics
+// format, which can be imported with `promtool tsdb create-blocks-from
+// openmetrics`.
+func serveBackfill(w http.ResponseWriter, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		http.Error(w, "Error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", string(expfmt.FmtOpenMetrics))
+	w.Header().Set("Content-Disposition", `attachment; filename="cloudwatch.om"`)
+	enc := expfmt.NewEncoder(w, expfmt.FmtOpenMetrics)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return enc.(expfmt.Closer).Close()
+}
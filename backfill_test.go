@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestBackfill(t *testing.T) {
+	var (
+		count  = 3
+		points = 10 // range / period
+	)
+	client := mock.NewCloudwatchAPIClient()
+	for i := 0; i < count; i++ {
+		client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-" + string(rune('a'+i))})
+	}
+
+	config := newReporterConfig()
+	config.rangeDuration = time.Duration(points) * time.Duration(config.period) * time.Second
+	config.stats = []string{"Sum"}
+	config.timestamps = true
+	config.backfill = true
+	config.namespace = "AWS/EC2"
+	config.metricNames = []string{"NetworkIn"}
+	collector := newTestCollector(t, client, &config)
+
+	mfs, err := backfillGatherer{collector}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(mfs); l != 1 {
+		t.Fatalf("Expected 1 metric family but got %d", l)
+	}
+	metrics := mfs[0].Metric
+	if l := len(metrics); l < count*points {
+		t.Fatalf("Expected at least %d samples but got %d", count*points, l)
+	}
+	for i := 1; i < len(metrics); i++ {
+		if labelsKey(metrics[i-1]) != labelsKey(metrics[i]) {
+			continue
+		}
+		if metrics[i-1].GetTimestampMs() >= metrics[i].GetTimestampMs() {
+			t.Fatalf("Expected samples in timestamp order but got %d before %d", metrics[i-1].GetTimestampMs(), metrics[i].GetTimestampMs())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := serveBackfill(w, backfillGatherer{collector}); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatalf("Expected OpenMetrics output but got %q", body)
+	}
+}
+
+func TestBackfillIncomplete(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-a"})
+	client.Fail("AWS/EC2", "NetworkIn", &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access denied"})
+
+	config := newReporterConfig()
+	config.stats = []string{"Sum"}
+	config.timestamps = true
+	config.backfill = true
+	config.namespace = "AWS/EC2"
+	config.metricNames = []string{"NetworkIn"}
+	collector := newTestCollector(t, client, &config)
+
+	w := httptest.NewRecorder()
+	err := serveBackfill(w, backfillGatherer{collector})
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("Expected AccessDenied error but got %v", err)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d but got %d", http.StatusInternalServerError, w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "# EOF") {
+		t.Fatalf("Expected no OpenMetrics output but got %q", body)
+	}
+}
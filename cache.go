@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// listCache caches ListMetrics results. Entries older than the TTL are still
+// returned while they get refreshed in the background. Entries older than
+// twice the TTL are considered expired and refreshed synchronously.
+type listCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[listCacheKey]*listCacheEntry
+	logger  log.Logger
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+type listCacheKey struct {
+	accountID      string
+	region         string
+	endpoint       string
+	namespace      string
+	metricName     string
+	dimensions     string
+	recentlyActive bool
+}
+
+type listCacheEntry struct {
+	metrics    []types.Metric
+	updated    time.Time
+	refreshing bool
+}
+
+func newListCache(logger log.Logger, ttl time.Duration, hits, misses prometheus.Counter) *listCache {
+	return &listCache{
+		ttl:     ttl,
+		entries: make(map[listCacheKey]*listCacheEntry),
+		logger:  logger,
+		hits:    hits,
+		misses:  misses,
+	}
+}
+
+// newListCacheKey returns the cache key for listing metricName with the given
+// reporter.
+func newListCacheKey(r *reporter, metricName string) listCacheKey {
+	dimensions := make([]string, len(r.config.dimensions))
+	for i, d := range r.config.dimensions {
+		dimensions[i] = *d.Name
+		if d.Value != nil {
+			dimensions[i] += "=" + *d.Value
+		}
+	}
+	return listCacheKey{
+		accountID:      r.accountID,
+		region:         r.region,
+		endpoint:       r.config.endpoint,
+		namespace:      r.config.namespace,
+		metricName:     metricName,
+		dimensions:     strings.Join(dimensions, ","),
+		recentlyActive: r.config.recentlyActive,
+	}
+}
+
+// get returns the cached metrics for key. On a miss, the metrics are listed
+// with list and stored in the cache. Background refreshes don't use ctx, since
+// they outlive the request.
+func (c *listCache) get(ctx context.Context, key listCacheKey, list func(context.Context) ([]types.Metric, error)) ([]types.Metric, error) {
+	now := time.Now()
+	c.Lock()
+	c.expire(now)
+	if e, ok := c.entries[key]; ok {
+		if now.Sub(e.updated) > c.ttl && !e.refreshing {
+			e.refreshing = true
+			go c.refresh(key, e, list)
+		}
+		c.Unlock()
+		c.hits.Inc()
+		return e.metrics, nil
+	}
+	c.Unlock()
+	c.misses.Inc()
+
+	metrics, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.entries[key] = &listCacheEntry{metrics: metrics, updated: time.Now()}
+	c.Unlock()
+	return metrics, nil
+}
+
+func (c *listCache) refresh(key listCacheKey, e *listCacheEntry, list func(context.Context) ([]types.Metric, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ttl)
+	defer cancel()
+	metrics, err := list(ctx)
+	c.Lock()
+	defer c.Unlock()
+	e.refreshing = false
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Couldn't refresh cached metric list", "namespace", key.namespace, "metric", key.metricName, "err", err)
+		return
+	}
+	// Entries are replaced instead of updated in place, since callers might
+	// still use the metrics of the old entry.
+	c.entries[key] = &listCacheEntry{metrics: metrics, updated: time.Now()}
+}
+
+// expire removes all expired entries. Needs to be called with the lock held.
+func (c *listCache) expire(now time.Time) {
+	for key, e := range c.entries {
+		if now.Sub(e.updated) > 2*c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// len returns the number of cached entries.
+func (c *listCache) len() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return float64(len(c.entries))
+}
+
+// maxAge returns the age in seconds of the oldest cached entry.
+func (c *listCache) maxAge() float64 {
+	c.Lock()
+	defer c.Unlock()
+	var age time.Duration
+	for _, e := range c.entries {
+		if a := time.Since(e.updated); a > age {
+			age = a
+		}
+	}
+	return age.Seconds()
+}
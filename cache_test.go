@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestListCache(t *testing.T) {
+	var (
+		ttl    = 100 * time.Millisecond
+		hits   = prometheus.NewCounter(prometheus.CounterOpts{Name: "hits_total"})
+		misses = prometheus.NewCounter(prometheus.CounterOpts{Name: "misses_total"})
+		cache  = newListCache(log.NewLogfmtLogger(os.Stdout), ttl, hits, misses)
+		key    = listCacheKey{namespace: "AWS/EC2", metricName: "NetworkIn"}
+
+		mu    sync.Mutex
+		calls int
+	)
+	list := func(context.Context) ([]types.Metric, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return []types.Metric{{MetricName: aws.String("NetworkIn")}}, nil
+	}
+	listCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	for i := 0; i < 3; i++ {
+		metrics, err := cache.get(context.Background(), key, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := len(metrics); l != 1 {
+			t.Fatalf("Expected 1 metric but got %d", l)
+		}
+	}
+	if c := listCalls(); c != 1 {
+		t.Fatalf("Expected 1 list call but got %d", c)
+	}
+	if h, m := testutil.ToFloat64(hits), testutil.ToFloat64(misses); h != 2 || m != 1 {
+		t.Fatalf("Expected 2 hits and 1 miss but got %v and %v", h, m)
+	}
+
+	// Stale entries are returned and refreshed in the background.
+	time.Sleep(ttl + ttl/2)
+	if _, err := cache.get(context.Background(), key, list); err != nil {
+		t.Fatal(err)
+	}
+	if h := testutil.ToFloat64(hits); h != 3 {
+		t.Fatalf("Expected stale entry to be a hit but got %v hits", h)
+	}
+	for i := 0; listCalls() != 2; i++ {
+		if i == 100 {
+			t.Fatal("Expected entry to be refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a := cache.maxAge(); a > ttl.Seconds() {
+		t.Fatalf("Expected refreshed entry but got age %v", a)
+	}
+
+	// Expired entries are listed synchronously.
+	time.Sleep(2*ttl + ttl/2)
+	if _, err := cache.get(context.Background(), key, func(context.Context) ([]types.Metric, error) {
+		return nil, errors.New("list failed")
+	}); err == nil {
+		t.Fatal("Expected error listing expired entry")
+	}
+	if m := testutil.ToFloat64(misses); m != 2 {
+		t.Fatalf("Expected 2 misses but got %v", m)
+	}
+	if l := cache.len(); l != 0 {
+		t.Fatalf("Expected expired entry to be removed but got %v entries", l)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultSessionName = "cloudwatch-exporter"
+	// maxPooledClients is the number of clients kept by the pool. The least
+	// recently used client is evicted first.
+	maxPooledClients = 100
+	// accountRetryInterval is how long a failed account ID lookup is
+	// returned before the account ID is looked up again.
+	accountRetryInterval = time.Minute
+	// accountLookupTimeout bounds looking up the account ID.
+	accountLookupTimeout = 10 * time.Second
+)
+
+// clientPool shares CloudWatch clients, and with them their HTTP transport
+// and credentials, across requests. The credentials are refreshed by the
+// credentials cache of the SDK when they expire. Failed requests are retried
+// according to the retry policy. All clients of the same account and region
+// share the same rate limiters.
+type clientPool struct {
+	sync.Mutex
+	clients    map[clientKey]*pooledClient
+	maxClients int
+	// Creates each client only once when requested concurrently
+	group    singleflight.Group
+	policy   retryPolicy
+	retries  *prometheus.CounterVec
+	limits   rateLimits
+	limiters map[limiterKey]*apiLimiters
+	wait     *prometheus.HistogramVec
+	tagsTTL  time.Duration
+}
+
+type clientKey struct {
+	region      string
+	roleARN     string
+	externalID  string
+	sessionName string
+	endpoint    string
+}
+
+// String returns the key as string for use with singleflight.
+func (k clientKey) String() string {
+	return strings.Join([]string{k.region, k.roleARN, k.externalID, k.sessionName, k.endpoint}, "\xff")
+}
+
+type pooledClient struct {
+	*retryingClient
+	region     string // resolved region
+	tags       *tagClient
+	limiterKey limiterKey
+	lastUsed   time.Time // guarded by the pool
+	// Looks up the account ID if the client doesn't assume a role
+	identity      callerIdentityAPIClient
+	accountID     string
+	accountErr    error     // error of the last failed lookup
+	accountFailed time.Time // time of the last failed lookup
+	accountLock   sync.Mutex
+	// Shares the lookup of the account ID between concurrent callers
+	accountGroup singleflight.Group
+}
+
+// callerIdentityAPIClient is the STS API used to look up the account ID.
+type callerIdentityAPIClient interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+func newClientPool(policy retryPolicy, retries *prometheus.CounterVec, limits rateLimits, wait *prometheus.HistogramVec, tagsTTL time.Duration) *clientPool {
+	return &clientPool{
+		clients:    make(map[clientKey]*pooledClient),
+		maxClients: maxPooledClients,
+		policy:     policy,
+		retries:    retries,
+		limits:     limits,
+		limiters:   make(map[limiterKey]*apiLimiters),
+		wait:       wait,
+		tagsTTL:    tagsTTL,
+	}
+}
+
+// get returns the client for the region, role and endpoint given in rconfig.
+// The client is created on first use.
+func (p *clientPool) get(rconfig *reporterConfig) (*pooledClient, error) {
+	key := clientKey{
+		region:      rconfig.region,
+		roleARN:     rconfig.roleARN,
+		externalID:  rconfig.externalID,
+		sessionName: rconfig.sessionName,
+		endpoint:    rconfig.endpoint,
+	}
+	if c := p.lookup(key); c != nil {
+		return c, nil
+	}
+	c, err, _ := p.group.Do(key.String(), func() (interface{}, error) {
+		if c := p.lookup(key); c != nil {
+			return c, nil
+		}
+		c, err := p.newClient(key)
+		if err != nil {
+			return nil, err
+		}
+		p.add(key, c)
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*pooledClient), nil
+}
+
+// lookup returns the pooled client for key or nil.
+func (p *clientPool) lookup(key clientKey) *pooledClient {
+	p.Lock()
+	defer p.Unlock()
+	c, ok := p.clients[key]
+	if !ok {
+		return nil
+	}
+	c.lastUsed = time.Now()
+	return c
+}
+
+// add adds the client to the pool, evicting the least recently used client
+// if the pool is full. Rate limiters not used by any client anymore are
+// removed along with it.
+func (p *clientPool) add(key clientKey, c *pooledClient) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.clients) >= p.maxClients {
+		var (
+			oldestKey clientKey
+			oldest    *pooledClient
+		)
+		for k, pc := range p.clients {
+			if oldest == nil || pc.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, pc
+			}
+		}
+		delete(p.clients, oldestKey)
+		if oldest.limiterKey != c.limiterKey && !p.usesLimiters(oldest.limiterKey) {
+			delete(p.limiters, oldest.limiterKey)
+		}
+	}
+	c.lastUsed = time.Now()
+	p.clients[key] = c
+}
+
+// usesLimiters returns whether any pooled client uses the limiters of lkey.
+func (p *clientPool) usesLimiters(lkey limiterKey) bool {
+	for _, c := range p.clients {
+		if c.limiterKey == lkey {
+			return true
+		}
+	}
+	return false
+}
+
+// apiLimiters returns the limiters of the given account and region.
+func (p *clientPool) apiLimiters(lkey limiterKey) *apiLimiters {
+	p.Lock()
+	defer p.Unlock()
+	limiters, ok := p.limiters[lkey]
+	if !ok {
+		limiters = newAPILimiters(p.limits)
+		p.limiters[lkey] = limiters
+	}
+	return limiters
+}
+
+// newClient creates a client for key.
+func (p *clientPool) newClient(key clientKey) (*pooledClient, error) {
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if key.region != "" {
+		opts = append(opts, awsconfig.WithRegion(key.region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if key.roleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), key.roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = key.sessionName
+			if o.RoleSessionName == "" {
+				o.RoleSessionName = defaultSessionName
+			}
+			if key.externalID != "" {
+				o.ExternalID = aws.String(key.externalID)
+			}
+		}))
+	}
+	client := cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+		// Retries are handled by the retryingClient.
+		o.Retryer = aws.NopRetryer{}
+		if key.endpoint != "" {
+			o.EndpointResolver = cloudwatch.EndpointResolverFromURL(key.endpoint)
+		}
+	})
+	lkey := limiterKey{region: cfg.Region}
+	if key.roleARN != "" {
+		// Already validated by the caller
+		lkey.accountID, _ = roleAccountID(key.roleARN)
+	}
+	limiters := p.apiLimiters(lkey)
+	// The endpoint only applies to CloudWatch.
+	tagging := resourcegroupstaggingapi.NewFromConfig(cfg, func(o *resourcegroupstaggingapi.Options) {
+		// Retries are handled by the retryingClient.
+		o.Retryer = aws.NopRetryer{}
+	})
+	c := &pooledClient{
+		retryingClient: &retryingClient{
+			client: &limitedClient{
+				client:   client,
+				tagging:  tagging,
+				limiters: limiters,
+				wait:     p.wait,
+			},
+			policy:  p.policy,
+			retries: p.retries,
+		},
+		region:     cfg.Region,
+		limiterKey: lkey,
+		accountID:  lkey.accountID,
+	}
+	c.tags = newTagClient(c, p.tagsTTL)
+	if key.roleARN == "" {
+		c.identity = sts.NewFromConfig(cfg)
+	}
+	return c, nil
+}
+
+// account returns the account ID of the client's credentials. Without a role,
+// it is looked up with STS GetCallerIdentity until the lookup succeeds. A
+// failed lookup is returned for accountRetryInterval before it is retried.
+func (c *pooledClient) account(ctx context.Context) (string, error) {
+	c.accountLock.Lock()
+	accountID, err, failed := c.accountID, c.accountErr, c.accountFailed
+	c.accountLock.Unlock()
+	if accountID != "" || c.identity == nil {
+		return accountID, nil
+	}
+	if err != nil && time.Since(failed) < accountRetryInterval {
+		return "", err
+	}
+	ch := c.accountGroup.DoChan("", func() (interface{}, error) {
+		// The lookup is shared, so it must not be canceled with the
+		// context of any one caller.
+		ctx, cancel := context.WithTimeout(context.Background(), accountLookupTimeout)
+		defer cancel()
+		out, err := c.identity.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		c.accountLock.Lock()
+		defer c.accountLock.Unlock()
+		if err != nil {
+			c.accountErr, c.accountFailed = err, time.Now()
+			return nil, err
+		}
+		c.accountID, c.accountErr = aws.ToString(out.Account), nil
+		return c.accountID, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// roleAccountID returns the account ID of the given role ARN.
+func roleAccountID(roleARN string) (string, error) {
+	a, err := arn.Parse(roleARN)
+	if err != nil {
+		return "", err
+	}
+	if a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") {
+		return "", fmt.Errorf("invalid role ARN %q", roleARN)
+	}
+	return a.AccountID, nil
+}
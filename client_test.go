@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRoleAccountID(t *testing.T) {
+	for _, tc := range []struct {
+		arn       string
+		accountID string
+		err       bool
+	}{
+		{arn: "arn:aws:iam::123456789012:role/cloudwatch", accountID: "123456789012"},
+		{arn: "arn:aws-cn:iam::123456789012:role/path/cloudwatch", accountID: "123456789012"},
+		{arn: "arn:aws:iam::123456789012:user/cloudwatch", err: true},
+		{arn: "arn:aws:s3:::bucket", err: true},
+		{arn: "cloudwatch", err: true},
+	} {
+		accountID, err := roleAccountID(tc.arn)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", tc.arn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.arn, err)
+		}
+		if accountID != tc.accountID {
+			t.Fatalf("%q: expected account ID %s but got %s", tc.arn, tc.accountID, accountID)
+		}
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	var (
+		p = newClientPool(retryPolicy{maxAttempts: 1}, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_api_retries_total",
+			Help: "Number of retried API calls.",
+		}, []string{"api_call", "code"}), rateLimits{}, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "cloudwatch_exporter_rate_limiter_wait_seconds",
+			Help: "Time spent waiting for the rate limiter.",
+		}, []string{"api_call"}), time.Minute)
+		a = &reporterConfig{region: "eu-west-1", roleARN: "arn:aws:iam::123456789012:role/a"}
+		b = &reporterConfig{region: "eu-west-1", roleARN: "arn:aws:iam::123456789012:role/b"}
+		c = &reporterConfig{region: "us-east-1", roleARN: "arn:aws:iam::123456789012:role/a"}
+	)
+	ca, err := p.get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.region != "eu-west-1" {
+		t.Fatalf("Expected region eu-west-1 but got %s", ca.region)
+	}
+	for _, tc := range []struct {
+		config *reporterConfig
+		same   bool
+	}{
+		{&reporterConfig{region: a.region, roleARN: a.roleARN}, true},
+		{b, false},
+		{c, false},
+		{&reporterConfig{region: a.region, roleARN: a.roleARN, endpoint: "http://localhost:4566"}, false},
+	} {
+		client, err := p.get(tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same := client == ca; same != tc.same {
+			t.Fatalf("%+v: expected same client %t but got %t", tc.config, tc.same, same)
+		}
+	}
+
+	// Clients of the same account and region share their rate limiters.
+	cb, err := p.get(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := p.get(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiters := func(c *pooledClient) *apiLimiters {
+		return c.retryingClient.client.(*limitedClient).limiters
+	}
+	if limiters(ca) != limiters(cb) {
+		t.Fatal("Expected clients of the same account and region to share limiters")
+	}
+	if limiters(ca) == limiters(cc) {
+		t.Fatal("Expected clients of different regions to have their own limiters")
+	}
+}
+
+type identityClient struct {
+	calls int
+	err   error
+}
+
+func (c *identityClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")}, nil
+}
+
+func TestPooledClientAccount(t *testing.T) {
+	identity := &identityClient{err: errors.New("no credentials")}
+	c := &pooledClient{identity: identity}
+	for i := 0; i < 2; i++ {
+		if _, err := c.account(context.Background()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+	if identity.calls != 1 {
+		t.Fatalf("Expected the failed lookup to be returned until the retry interval passed but got %d calls", identity.calls)
+	}
+	identity.err = nil
+	c.accountFailed = c.accountFailed.Add(-accountRetryInterval)
+	for i := 0; i < 2; i++ {
+		accountID, err := c.account(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accountID != "123456789012" {
+			t.Fatalf("Expected account ID 123456789012 but got %q", accountID)
+		}
+	}
+	if identity.calls != 2 {
+		t.Fatalf("Expected the account ID to be looked up until it succeeds but got %d calls", identity.calls)
+	}
+}
+
+func TestClientPoolEviction(t *testing.T) {
+	p := newClientPool(retryPolicy{maxAttempts: 1}, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_api_retries_total",
+		Help: "Number of retried API calls.",
+	}, []string{"api_call", "code"}), rateLimits{}, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "cloudwatch_exporter_rate_limiter_wait_seconds",
+		Help: "Time spent waiting for the rate limiter.",
+	}, []string{"api_call"}), time.Minute)
+	p.maxClients = 2
+	var (
+		a = &reporterConfig{region: "eu-west-1", roleARN: "arn:aws:iam::123456789012:role/a"}
+		b = &reporterConfig{region: "eu-west-1", roleARN: "arn:aws:iam::210987654321:role/b"}
+		c = &reporterConfig{region: "eu-west-1", roleARN: "arn:aws:iam::123456789012:role/c"}
+	)
+	for _, config := range []*reporterConfig{a, b, a, c} {
+		if _, err := p.get(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l := len(p.clients); l != 2 {
+		t.Fatalf("Expected 2 clients but got %d", l)
+	}
+	if p.lookup(clientKey{region: b.region, roleARN: b.roleARN}) != nil {
+		t.Fatal("Expected the least recently used client to be evicted")
+	}
+	if l := len(p.limiters); l != 1 {
+		t.Fatalf("Expected the limiters of the evicted account to be removed but got %d", l)
+	}
+}
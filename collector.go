@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -8,15 +9,19 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/smithy-go"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stoewer/go-strcase"
 )
 
-const batchSize = 500
+// maxBatchSize is the maximum number of queries per GetMetricData call.
+const maxBatchSize = 500
 
 var (
 	errNotSameLength = errors.New("Metrics returned not same length")
@@ -25,26 +30,55 @@ var (
 )
 
 type collector struct {
+	// Context of the request, used for all API calls
+	ctx    context.Context
 	logger log.Logger
 	*reporter
 	descMap      map[string]*prometheus.Desc
+	families     map[*prometheus.Desc]*dto.MetricFamily
 	descLock     sync.Mutex
 	metricsDesc  *prometheus.Desc
 	metricsSent  uint64
 	errorCounter prometheus.Counter
-	errDesc      *prometheus.Desc
-	concurrency  int
+	// Number of queried metrics without data points
+	emptyResultsCounter *prometheus.CounterVec
+	errDesc             *prometheus.Desc
+	deadlineDesc        *prometheus.Desc
+	deadlineExceeded    uint32
+	batchErrorsDesc     *prometheus.Desc
+	scrapeSuccessDesc   *prometheus.Desc
+	// Number of failed batches by reason
+	batchErrors     map[string]int
+	batchErrorsLock sync.Mutex
+	// Shared by all collectors
+	limiter concurrencyLimiter
+	// Resources aws_resource_info was sent for
+	resourceInfoSent map[string]bool
+	resourceInfoLock sync.Mutex
+	tagErrorOnce     sync.Once
+	// Tags of the resources by namespace, looked up once per scrape
+	resourceTags     map[string]map[string]map[string]string
+	resourceTagsLock sync.Mutex
 }
 
-func newCollector(logger log.Logger, reporter *reporter, errorCounter prometheus.Counter) *collector {
+func newCollector(ctx context.Context, logger log.Logger, reporter *reporter, errorCounter prometheus.Counter, emptyResultsCounter *prometheus.CounterVec, limiter concurrencyLimiter) *collector {
 	return &collector{
-		logger:       logger,
-		reporter:     reporter,
-		descMap:      make(map[string]*prometheus.Desc),
-		errDesc:      prometheus.NewDesc("cloudwatch_error", "Error collecting metrics", nil, nil),
-		metricsDesc:  prometheus.NewDesc("aws_metrics_sent", "Number of metrics sent in this scrape", nil, nil),
-		errorCounter: errorCounter,
-		concurrency:  10,
+		ctx:                 ctx,
+		logger:              logger,
+		reporter:            reporter,
+		descMap:             make(map[string]*prometheus.Desc),
+		families:            make(map[*prometheus.Desc]*dto.MetricFamily),
+		errDesc:             prometheus.NewDesc("cloudwatch_error", "Error collecting metrics", nil, nil),
+		metricsDesc:         prometheus.NewDesc("aws_metrics_sent", "Number of metrics sent in this scrape", nil, nil),
+		deadlineDesc:        prometheus.NewDesc("cloudwatch_deadline_exceeded", "Whether the scrape timed out and only partial results were returned", nil, nil),
+		batchErrorsDesc:     prometheus.NewDesc("cloudwatch_exporter_batch_errors", "Number of batches that failed in this scrape", []string{"namespace", "reason"}, nil),
+		scrapeSuccessDesc:   prometheus.NewDesc("cloudwatch_exporter_scrape_success", "Whether all metrics were collected successfully", nil, nil),
+		batchErrors:         make(map[string]int),
+		errorCounter:        errorCounter,
+		emptyResultsCounter: emptyResultsCounter,
+		limiter:             limiter,
+		resourceInfoSent:    make(map[string]bool),
+		resourceTags:        make(map[string]map[string]map[string]string),
 	}
 }
 
@@ -55,60 +89,155 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements Prometheus.Collector.
 func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	metrics, err := c.reporter.ListMetrics()
+	if c.config.insightsQuery != "" {
+		c.collectInsights(ch)
+	} else if c.config.search != "" {
+		c.collectSearch(ch)
+	} else if !c.collectListed(ch) {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.metricsDesc,
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&c.metricsSent)),
+	)
+	success := 1.0
+	if atomic.LoadUint32(&c.deadlineExceeded) == 1 {
+		level.Warn(c.logger).Log("msg", "deadline exceeded, returning partial results", "metrics", atomic.LoadUint64(&c.metricsSent))
+		c.errorCounter.Inc()
+		ch <- prometheus.MustNewConstMetric(c.deadlineDesc, prometheus.GaugeValue, 1)
+		success = 0
+	}
+	c.batchErrorsLock.Lock()
+	for reason, n := range c.batchErrors {
+		ch <- prometheus.MustNewConstMetric(c.batchErrorsDesc, prometheus.GaugeValue, float64(n), c.config.namespace, reason)
+		success = 0
+	}
+	c.batchErrorsLock.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.scrapeSuccessDesc, prometheus.GaugeValue, success)
+}
+
+// collectListed collects the listed metrics in batches. It returns false if
+// listing the metrics failed.
+func (c *collector) collectListed(ch chan<- prometheus.Metric) bool {
+	metrics, err := c.reporter.ListMetrics(c.ctx)
 	if err != nil {
 		level.Error(c.logger).Log("msg", "failed to list metrics", "err", err)
 		c.errorCounter.Inc()
-		ch <- prometheus.NewInvalidMetric(c.errDesc, err)
-		return
+		if c.config.strict {
+			ch <- prometheus.NewInvalidMetric(c.errDesc, err)
+			return false
+		}
+		ch <- prometheus.MustNewConstMetric(c.scrapeSuccessDesc, prometheus.GaugeValue, 0)
+		return false
 	}
 	level.Debug(c.logger).Log("msg", "list metrics returned", "metrics", metrics)
+	metrics = filterMetrics(metrics, c.config)
 
-	// if we have less than batchSize results, we don't want to have zero entries
-	length := len(metrics)
-	if length > batchSize {
-		length = batchSize
-	}
-	var (
-		scratch = make([]types.Metric, length, batchSize)
-		i       = 0
-		sem     = make(chan bool, c.concurrency)
-	)
-	for _, metric := range metrics {
-		scratch[i] = metric
-		i++
-		if i < batchSize {
-			continue
-		}
-		i = 0
-		batch := make([]types.Metric, length, batchSize)
+	sem := make(chan bool, c.config.concurrency)
+	for _, batch := range c.batches(metrics) {
 		sem <- true
-		copy(batch, scratch)
+		if err := c.limiter.acquire(c.ctx); err != nil {
+			<-sem
+			atomic.StoreUint32(&c.deadlineExceeded, 1)
+			break
+		}
 		go func(batch []types.Metric) {
 			c.collectBatch(ch, batch)
+			c.limiter.release()
 			<-sem
 		}(batch)
 	}
-	// The length of the array might be bigger than the number of entries when processing more than one batch
-	batch := make([]types.Metric, length, batchSize)
-	sem <- true
-	copy(batch, scratch)
-	go func(batch []types.Metric) {
-		c.collectBatch(ch, batch[:i])
-		<-sem
-	}(batch)
 	for i := 0; i < cap(sem); i++ {
 		sem <- true
 	}
+	return true
+}
 
-	ch <- prometheus.MustNewConstMetric(
-		c.metricsDesc,
-		prometheus.GaugeValue,
-		float64(atomic.LoadUint64(&c.metricsSent)),
-	)
+// batches splits the metrics into batches of at most batchSize queries.
+func (c *collector) batches(metrics []types.Metric) [][]types.Metric {
+	if len(c.config.expressions) > 0 {
+		return expressionBatches(metrics, c.config)
+	}
+	// Each metric is queried once per statistic, so we need to reduce the
+	// number of metrics per batch accordingly.
+	n := c.config.batchSize / len(c.config.stats)
+	if n < 1 {
+		n = 1
+	}
+	batches := [][]types.Metric{}
+	for start := 0; start < len(metrics); start += n {
+		end := start + n
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		batches = append(batches, metrics[start:end])
+	}
+	return batches
+}
+
+// batchFailed reports a failed batch. In strict mode the error fails the
+// whole scrape, otherwise it's reported in cloudwatch_exporter_batch_errors
+// and the other batches are still returned.
+func (c *collector) batchFailed(ch chan<- prometheus.Metric, reason string, err error) {
+	c.errorCounter.Inc()
+	if c.config.strict {
+		ch <- prometheus.NewInvalidMetric(c.errDesc, err)
+		return
+	}
+	c.batchErrorsLock.Lock()
+	c.batchErrors[reason]++
+	c.batchErrorsLock.Unlock()
+}
+
+// errorReason returns the AWS error code of err, if any.
+func errorReason(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return "unknown"
+}
+
+// filterMetrics returns the metrics matching the client side filters of the
+// given config.
+func filterMetrics(metrics []types.Metric, config *reporterConfig) []types.Metric {
+	if config.metricNameRegexp == nil && config.metricNameExcludeRegexp == nil && len(config.dimensionRegexps) == 0 {
+		return metrics
+	}
+	filtered := []types.Metric{}
+	for _, m := range metrics {
+		if matchMetric(m, config) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func matchMetric(m types.Metric, config *reporterConfig) bool {
+	if config.metricNameRegexp != nil && !config.metricNameRegexp.MatchString(*m.MetricName) {
+		return false
+	}
+	if config.metricNameExcludeRegexp != nil && config.metricNameExcludeRegexp.MatchString(*m.MetricName) {
+		return false
+	}
+	for name, r := range config.dimensionRegexps {
+		found := false
+		for _, d := range m.Dimensions {
+			if *d.Name == name && r.MatchString(*d.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *collector) collectMetric(ch chan<- prometheus.Metric, m *types.Metric, value float64) {
+func (c *collector) collectMetric(ch chan<- prometheus.Metric, m *types.Metric, stat string, value float64, ts time.Time) {
 	var (
 		namespace = strcase.SnakeCase(prometheusMetricNameRegexp.ReplaceAllString(*m.Namespace, "_"))
 		name      = strcase.SnakeCase(prometheusMetricNameRegexp.ReplaceAllString(*m.MetricName, "_"))
@@ -121,28 +250,74 @@ func (c *collector) collectMetric(ch chan<- prometheus.Metric, m *types.Metric,
 		lns[i] = strcase.SnakeCase(*d.Name)
 		lvs[i] = *d.Value
 	}
+	lns, lvs = c.resourceLabels(ch, m, lns, lvs, ts)
+	fqName := namespace + "_" + name + "_" + statSuffix(stat)
+	help := fmt.Sprintf("Cloudwatch Metric %s/%s", *m.Namespace, *m.MetricName)
+	c.sendMetric(ch, fqName, help, lns, lvs, value, ts)
+}
+
+// resourceLabels adds the tags of the resource referenced by m to the labels
+// or, if configured, sends them as aws_resource_info metric.
+func (c *collector) resourceLabels(ch chan<- prometheus.Metric, m *types.Metric, lns, lvs []string, ts time.Time) ([]string, []string) {
+	if len(c.config.tagKeys) == 0 {
+		return lns, lvs
+	}
+	if c.config.tagInfo {
+		c.sendResourceInfo(ch, m, ts)
+		return lns, lvs
+	}
+	tags, _ := c.metricTags(m)
+	return c.tagLabels(lns, lvs, tags)
+}
 
-	key := strings.Join(lns, " ")
+// sendMetric sends a sample with the given labels plus the region and, if
+// known, the account_id label.
+func (c *collector) sendMetric(ch chan<- prometheus.Metric, fqName, help string, lns, lvs []string, value float64, ts time.Time) {
+	lns, lvs = appendLabel(lns, lvs, "region", c.reporter.region)
+	if c.reporter.accountID != "" {
+		lns, lvs = appendLabel(lns, lvs, "account_id", c.reporter.accountID)
+	}
+
+	key := fqName + " " + strings.Join(lns, " ")
 	level.Debug(c.logger).Log("msg", "Using key", "key", key)
 	c.descLock.Lock()
 	desc, ok := c.descMap[key]
 	if !ok {
 		level.Debug(c.logger).Log("msg", "Key not found, creating new decs")
-		statSuffix := strings.ToLower(c.reporter.config.stat)
-		desc = prometheus.NewDesc(namespace+"_"+name+"_"+statSuffix, fmt.Sprintf("Cloudwatch Metric %s/%s", *m.Namespace, *m.MetricName), lns, nil)
+		desc = prometheus.NewDesc(fqName, help, lns, nil)
 		c.descMap[key] = desc
+		c.families[desc] = &dto.MetricFamily{
+			Name: &fqName,
+			Help: &help,
+			Type: dto.MetricType_UNTYPED.Enum(),
+		}
 	}
+	c.descLock.Unlock()
 	level.Debug(c.logger).Log("msg", "Sending metric", "desc", desc.String(), "lvs", fmt.Sprintf("%+v", lvs), "value", fmt.Sprintf("%f", value))
-	ch <- prometheus.MustNewConstMetric(
+	metric := prometheus.MustNewConstMetric(
 		desc,
 		prometheus.UntypedValue,
 		value,
 		lvs...,
 	)
-	c.descLock.Unlock()
+	if c.config.timestamps && !ts.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(ts, metric)
+	}
+	ch <- metric
 	atomic.AddUint64(&c.metricsSent, 1)
 }
 
+// appendLabel appends the given label unless a dimension with the same name
+// exists already.
+func appendLabel(lns, lvs []string, name, value string) ([]string, []string) {
+	for _, ln := range lns {
+		if ln == name {
+			return lns, lvs
+		}
+	}
+	return append(lns, name), append(lvs, value)
+}
+
 func sprintDims(ds []types.Dimension) (out string) {
 	for _, d := range ds {
 		out = fmt.Sprintf("%s%s=%s,", out, *d.Name, *d.Value)
@@ -156,34 +331,66 @@ func (c *collector) collectBatch(ch chan<- prometheus.Metric, metrics []types.Me
 	if len(metrics) == 0 {
 		return
 	}
-	results, err := c.reporter.GetMetricsResults(metrics)
+	queries, exprResults := c.reporter.expressionQueries(metrics)
+	results, err := c.reporter.GetMetricsResults(c.ctx, metrics, queries...)
+	// Batches not completed in time are dropped, the results of the other
+	// batches are still returned.
+	if err != nil && (c.ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded)) {
+		atomic.StoreUint32(&c.deadlineExceeded, 1)
+		return
+	}
 	if err != nil {
 		level.Error(c.logger).Log("msg", "failed to get metric results", "err", err)
-		c.errorCounter.Inc()
-		ch <- prometheus.NewInvalidMetric(c.errDesc, err)
+		c.batchFailed(ch, errorReason(err), err)
 		return
 	}
-	nr := len(results)
-	nm := len(metrics)
+	var (
+		ns = len(c.config.stats)
+		nr = 0
+		nm = len(metrics) * ns
+	)
+	for _, result := range results {
+		if !strings.HasPrefix(*result.Id, "e") {
+			nr++
+		}
+	}
 	if nr != nm {
 		level.Error(c.logger).Log("msg", "not same length", "results", nr, "metrics", nm)
-		c.errorCounter.Inc()
-		ch <- prometheus.NewInvalidMetric(c.errDesc, errNotSameLength)
+		c.batchFailed(ch, "result_count_mismatch", errNotSameLength)
 		return
 	}
 	for _, result := range results {
-		// idx is index in batch
-		idx, err := strconv.Atoi((*result.Id)[1:]) // strip "n" prefix
+		// q is the query index in batch, or the expression index
+		q, err := strconv.Atoi((*result.Id)[1:]) // strip "n" or "e" prefix
 		if err != nil {
 			panic(err)
 		}
+		if strings.HasPrefix(*result.Id, "e") {
+			c.collectExpression(ch, exprResults[q], result)
+			continue
+		}
 		level.Debug(c.logger).Log("id", *result.Id)
-		m := metrics[idx]
+		var (
+			idx  = q / ns
+			stat = c.config.stats[q%ns]
+			m    = metrics[idx]
+		)
 		level.Debug(c.logger).Log("msg", "creating metric", "index", idx, "dimensions", sprintDims(m.Dimensions))
 		if len(result.Values) == 0 {
 			level.Debug(c.logger).Log("msg", "no values found")
+			c.emptyResultsCounter.WithLabelValues(*m.Namespace).Inc()
 			continue
 		}
-		c.collectMetric(ch, &m, result.Values[0])
+		if c.config.backfill {
+			for i, value := range result.Values {
+				c.collectMetric(ch, &m, stat, value, result.Timestamps[i])
+			}
+			continue
+		}
+		var ts time.Time
+		if len(result.Timestamps) > 0 {
+			ts = result.Timestamps[0]
+		}
+		c.collectMetric(ch, &m, stat, result.Values[0], ts)
 	}
 }
@@ -1,16 +1,51 @@
 package main
 
 import (
+	"context"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/discordianfish/cloudwatch-exporter/mock"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/smithy-go"
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// newTestCollector returns a collector for the config getting all metrics
+// from client.
+func newTestCollector(t *testing.T, client *mock.CloudwatchAPIClient, config *reporterConfig) *collector {
+	t.Helper()
+	reporter := &reporter{
+		ListMetricsAPIClient:   client,
+		GetMetricDataAPIClient: client,
+		config:                 config,
+		durationSummary: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "cloudwatch_request_duration_seconds",
+			Help: "Duration of cloudwatch metric collection.",
+		}, []string{"metric_namespace", "metric_name", "api_call"}),
+	}
+	return newCollector(context.Background(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)), reporter,
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_errors_total",
+			Help: "Number of errors.",
+		}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudwatch_metrics_without_datapoints_total",
+			Help: "Number of queried metrics without data points.",
+		}, []string{"metric_namespace"}),
+		nil,
+	)
+}
+
 func TestCollector(t *testing.T) {
 	var (
 		metricNames = []string{"NetworkIn", "NetworkOut", "NetworkPacketsIn", "NetworkPacketsOut"}
@@ -23,40 +58,35 @@ func TestCollector(t *testing.T) {
 	}
 	client.InsertRandom("AWS/EBS", "VolumeWriteBytes", count)
 
-	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
 	for _, tc := range []struct {
 		namespace  string
 		metricName string
+		stats      []string
+		timestamps bool
 		count      int
 	}{
-		{"AWS/EC2", "NetworkIn", count},
-		{"AWS/EC2", "*", count * len(metricNames)},
-		{"AWS/EBS", "VolumeWriteBytes", count},
-		{"AWS/EBS", "*", count},
-		{"*", "*", count * (len(metricNames) + 1)}, // Also returns the EBS metric
+		{"AWS/EC2", "NetworkIn", []string{"Maximum"}, false, count},
+		{"AWS/EC2", "*", []string{"Maximum"}, false, count * len(metricNames)},
+		{"AWS/EBS", "VolumeWriteBytes", []string{"Maximum"}, false, count},
+		{"AWS/EBS", "*", []string{"Maximum"}, false, count},
+		{"*", "*", []string{"Maximum"}, false, count * (len(metricNames) + 1)}, // Also returns the EBS metric
+		{"AWS/EC2", "NetworkIn", []string{"Sum", "Maximum", "p99"}, false, count * 3},
+		{"*", "*", []string{"Sum", "Average", "Minimum", "Maximum", "SampleCount"}, false, count * (len(metricNames) + 1) * 5},
+		{"AWS/EC2", "NetworkIn", []string{"Maximum"}, true, count},
 	} {
-		reporter := &reporter{
-			ListMetricsAPIClient:   client,
-			GetMetricDataAPIClient: client,
-			config: &reporterConfig{
-				delayDuration: 600 * time.Second,
-				rangeDuration: 600 * time.Second,
-				period:        60,
-				stat:          "Maximum",
-			},
-			namespace:  tc.namespace,
-			metricName: tc.metricName,
-			durationSummary: prometheus.NewSummaryVec(prometheus.SummaryOpts{
-				Name: "cloudwatch_request_duration_seconds",
-				Help: "Duration of cloudwatch metric collection.",
-			}, []string{"metric_namespace", "metric_name", "api_call"}),
-		}
-		collector := newCollector(logger, reporter,
-			prometheus.NewCounter(prometheus.CounterOpts{
-				Name: "cloudwatch_errors_total",
-				Help: "Number of errors.",
-			}),
-		)
+		collector := newTestCollector(t, client, &reporterConfig{
+			namespace:     tc.namespace,
+			metricNames:   []string{tc.metricName},
+			delayDuration: 600 * time.Second,
+			rangeDuration: 600 * time.Second,
+			period:        60,
+			batchSize:     maxBatchSize,
+			concurrency:   10,
+			stats:         tc.stats,
+			timestamps:    tc.timestamps,
+		})
+		collector.region = "eu-west-1"
+		collector.accountID = "123456789012"
 
 		metrics := []prometheus.Metric{}
 
@@ -70,9 +100,214 @@ func TestCollector(t *testing.T) {
 			t.Logf("Got metric %v", m)
 		}
 
-		// +1 to account for aws_metrics_collected gauge
-		if c := len(metrics); c != tc.count+1 {
+		// +2 to account for aws_metrics_sent and scrape_success gauges
+		if c := len(metrics); c != tc.count+2 {
 			t.Fatalf("Expected %d but got %d results", tc.count, c)
 		}
+		for _, m := range metrics[:tc.count] {
+			pb := &dto.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatal(err)
+			}
+			if hasTimestamp := pb.TimestampMs != nil; hasTimestamp != tc.timestamps {
+				t.Fatalf("Expected timestamp %t but got %v", tc.timestamps, pb.TimestampMs)
+			}
+			if v := labelValue(pb, "region"); v != "eu-west-1" {
+				t.Fatalf("Expected region label eu-west-1 but got %q", v)
+			}
+			if v := labelValue(pb, "account_id"); v != "123456789012" {
+				t.Fatalf("Expected account_id label 123456789012 but got %q", v)
+			}
+		}
+	}
+}
+
+func TestCollectorRecentlyActive(t *testing.T) {
+	var (
+		active   = 23
+		inactive = 42
+	)
+	client := mock.NewCloudwatchAPIClient()
+	client.InsertRandom("AWS/EC2", "NetworkIn", active)
+	client.InsertInactive("AWS/EC2", "NetworkOut", inactive)
+
+	for _, tc := range []struct {
+		recentlyActive bool
+		count          int
+		empty          int
+	}{
+		{false, active, inactive},
+		{true, active, 0},
+	} {
+		collector := newTestCollector(t, client, &reporterConfig{
+			namespace:      "AWS/EC2",
+			metricNames:    []string{"*"},
+			recentlyActive: tc.recentlyActive,
+			delayDuration:  600 * time.Second,
+			rangeDuration:  600 * time.Second,
+			period:         60,
+			batchSize:      maxBatchSize,
+			concurrency:    10,
+			stats:          []string{"Average"},
+		})
+
+		ch := make(chan prometheus.Metric)
+		go func() {
+			collector.Collect(ch)
+			close(ch)
+		}()
+		c := 0
+		for range ch {
+			c++
+		}
+		// +2 to account for aws_metrics_sent and scrape_success gauges
+		if c != tc.count+2 {
+			t.Fatalf("recently_active=%t: expected %d but got %d results", tc.recentlyActive, tc.count, c-2)
+		}
+		if e := testutil.ToFloat64(collector.emptyResultsCounter.WithLabelValues("AWS/EC2")); int(e) != tc.empty {
+			t.Fatalf("recently_active=%t: expected %d but got %v metrics without data points", tc.recentlyActive, tc.empty, e)
+		}
+	}
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestFilterMetrics(t *testing.T) {
+	metric := func(name string, dims ...string) types.Metric {
+		m := types.Metric{Namespace: aws.String("Glue"), MetricName: aws.String(name)}
+		for i := 0; i < len(dims); i += 2 {
+			m.Dimensions = append(m.Dimensions, types.Dimension{Name: aws.String(dims[i]), Value: aws.String(dims[i+1])})
+		}
+		return m
+	}
+	metrics := []types.Metric{
+		metric("glue.driver.s3.filesystem.read_bytes", "JobName", "etl-prod", "Type", "gauge"),
+		metric("glue.driver.s3.filesystem.write_bytes", "JobName", "etl-staging", "Type", "gauge"),
+		metric("glue.driver.jvm.heap.usage", "JobName", "etl-prod", "Type", "gauge"),
+		metric("glue.ALL.jvm.heap.usage", "JobName", "etl-prod"),
+	}
+	for _, tc := range []struct {
+		query string
+		count int
+	}{
+		{"", 4},
+		{`metric_name_regex=^glue\.driver\.`, 3},
+		{`metric_name_regex=^glue\.driver\.&metric_name_exclude_regex=write`, 2},
+		{`metric_name_exclude_regex=heap`, 2},
+		{`dimension_regex=JobName=-prod$`, 3},
+		{`dimension_regex=JobName=-prod$&dimension_regex=Type=.*`, 2},
+		{`dimension_regex=Unknown=.*`, 0},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := configFromQuery(newReporterConfig(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := len(filterMetrics(metrics, config)); c != tc.count {
+			t.Fatalf("%q: expected %d but got %d metrics", tc.query, tc.count, c)
+		}
+	}
+}
+
+func TestCollectorDeadlineExceeded(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	client.InsertRandom("AWS/EC2", "NetworkIn", 23)
+
+	collector := newTestCollector(t, client, &reporterConfig{
+		namespace:     "AWS/EC2",
+		metricNames:   []string{"NetworkIn"},
+		delayDuration: 600 * time.Second,
+		rangeDuration: 600 * time.Second,
+		period:        60,
+		batchSize:     maxBatchSize,
+		concurrency:   10,
+		stats:         []string{"Average"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	collector.ctx = ctx
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	if expected := []string{"aws_metrics_sent", "cloudwatch_deadline_exceeded", "cloudwatch_exporter_scrape_success"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected metrics %v but got %v", expected, names)
+	}
+	if c := testutil.ToFloat64(collector.errorCounter); c != 1 {
+		t.Fatalf("Expected 1 error but got %v", c)
+	}
+}
+
+func TestCollectorBatchErrors(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	for i := 0; i < maxBatchSize; i++ {
+		client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 10; i++ {
+		client.Insert("AWS/EC2", "NetworkOut", map[string]string{"InstanceId": "i-" + strconv.Itoa(i)})
+	}
+	client.Fail("AWS/EC2", "NetworkOut", &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"})
+
+	for _, strict := range []bool{false, true} {
+		collector := newTestCollector(t, client, &reporterConfig{
+			namespace: "AWS/EC2",
+			// The metrics are batched in this order, so all NetworkOut
+			// metrics end up in the second batch.
+			metricNames:   []string{"NetworkIn", "NetworkOut"},
+			delayDuration: 600 * time.Second,
+			rangeDuration: 600 * time.Second,
+			period:        60,
+			batchSize:     maxBatchSize,
+			concurrency:   10,
+			stats:         []string{"Average"},
+			strict:        strict,
+		})
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		mfs, err := registry.Gather()
+		if strict {
+			if err == nil {
+				t.Fatal("strict: expected error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := make(map[string]*dto.MetricFamily)
+		for _, mf := range mfs {
+			families[mf.GetName()] = mf
+		}
+		if l := len(families["aws_ec2_network_in_average"].GetMetric()); l != maxBatchSize {
+			t.Fatalf("Expected %d metrics of the successful batch but got %d", maxBatchSize, l)
+		}
+		if _, ok := families["aws_ec2_network_out_average"]; ok {
+			t.Fatal("Expected no metrics of the failed batch")
+		}
+		batchErrors := families["cloudwatch_exporter_batch_errors"].GetMetric()
+		if len(batchErrors) != 1 || labelValue(batchErrors[0], "reason") != "Throttling" || batchErrors[0].GetGauge().GetValue() != 1 {
+			t.Fatalf("Expected one Throttling batch error but got %v", batchErrors)
+		}
+		if v := families["cloudwatch_exporter_scrape_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+			t.Fatalf("Expected scrape_success 0 but got %v", v)
+		}
 	}
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is the content of the configuration file.
+type config struct {
+	Jobs []*jobConfig `yaml:"jobs"`
+}
+
+// safeConfig holds the current config and allows to reload it from file at
+// runtime.
+type safeConfig struct {
+	sync.RWMutex
+	c    *config
+	file string
+	// Reporter config the jobs are validated with
+	defaults reporterConfig
+
+	reloadSuccess prometheus.Gauge
+	reloadSeconds prometheus.Gauge
+}
+
+func newSafeConfig(file string, defaults reporterConfig, reloadSuccess, reloadSeconds prometheus.Gauge) *safeConfig {
+	return &safeConfig{
+		c:             &config{},
+		file:          file,
+		defaults:      defaults,
+		reloadSuccess: reloadSuccess,
+		reloadSeconds: reloadSeconds,
+	}
+}
+
+// get returns the current config.
+func (sc *safeConfig) get() *config {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.c
+}
+
+// reload loads and validates the config file. The current config is only
+// replaced if the new one is valid.
+func (sc *safeConfig) reload() error {
+	if sc.file == "" {
+		return errors.New("no config file given")
+	}
+	c, err := loadConfig(sc.file)
+	if err == nil {
+		err = c.validateBatches(sc.defaults)
+	}
+	if err != nil {
+		sc.reloadSuccess.Set(0)
+		return err
+	}
+	sc.Lock()
+	sc.c = c
+	sc.Unlock()
+	sc.reloadSuccess.Set(1)
+	sc.reloadSeconds.SetToCurrentTime()
+	return nil
+}
+
+// jobConfig describes a named scrape job, served on /probe?job=<name>. Jobs
+// with a poll interval are additionally polled in the background.
+type jobConfig struct {
+	Name                   string             `yaml:"name"`
+	Region                 string             `yaml:"region"`
+	RoleARN                string             `yaml:"role_arn"`
+	ExternalID             string             `yaml:"external_id"`
+	SessionName            string             `yaml:"session_name"`
+	Endpoint               string             `yaml:"endpoint"`
+	Namespace              string             `yaml:"namespace"`
+	Query                  string             `yaml:"query"`
+	QueryMetricName        string             `yaml:"query_metric_name"`
+	Search                 string             `yaml:"search"`
+	MetricNames            []string           `yaml:"metric_names"`
+	MetricNameRegex        string             `yaml:"metric_name_regex"`
+	MetricNameExcludeRegex string             `yaml:"metric_name_exclude_regex"`
+	Dimensions             []dimensionConfig  `yaml:"dimensions"`
+	DimensionRegexes       map[string]string  `yaml:"dimension_regexes"`
+	Expressions            []expressionConfig `yaml:"expressions"`
+	TagKeys                []string           `yaml:"tag_keys"`
+	TagInfo                bool               `yaml:"tag_info"`
+	TagFilters             []tagFilterConfig  `yaml:"tag_filters"`
+	RecentlyActive         *bool              `yaml:"recently_active"`
+	Stats                  []string           `yaml:"stats"`
+	Period                 model.Duration     `yaml:"period"`
+	Delay                  model.Duration     `yaml:"delay"`
+	Range                  model.Duration     `yaml:"range"`
+	PollInterval           model.Duration     `yaml:"poll_interval"`
+	BatchSize              int                `yaml:"batch_size"`
+	Concurrency            int                `yaml:"concurrency"`
+
+	metricNameRegexp        *regexp.Regexp
+	metricNameExcludeRegexp *regexp.Regexp
+	dimensionRegexps        map[string]*regexp.Regexp
+	expressions             []expression
+	searchNamespace         string
+	tagFilters              []tagFilter
+	searchDimensions        []string
+}
+
+// tagFilterConfig filters metrics by the tags of the resources they refer
+// to. If value is empty, all resources having the tag match.
+type tagFilterConfig struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+// expressionConfig is a metric math expression referring to metrics by
+// metric name. It's evaluated for each set of dimensions all referenced
+// metrics are listed with.
+type expressionConfig struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	// Statistic of the referenced metrics, defaults to the first one of
+	// the job
+	Stat string `yaml:"stat"`
+}
+
+// dimensionConfig filters metrics by dimension. If value is empty, all
+// metrics having the dimension match.
+type dimensionConfig struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+func loadConfig(file string) (*config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(b)
+}
+
+func parseConfig(b []byte) (*config, error) {
+	c := &config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, job := range c.Jobs {
+		if job.Name == "" {
+			return nil, fmt.Errorf("job %d: name required", i)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("job %s: duplicate name", job.Name)
+		}
+		names[job.Name] = true
+		if err := job.validate(); err != nil {
+			return nil, fmt.Errorf("job %s: %s", job.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// validateBatches checks that the jobs of the config fit into batches of
+// their effective batch size, which defaults to the one of defaults.
+func (c *config) validateBatches(defaults reporterConfig) error {
+	for _, job := range c.Jobs {
+		if err := job.reporterConfig(defaults).validateBatchSize(); err != nil {
+			return fmt.Errorf("job %s: %s", job.Name, err)
+		}
+	}
+	return nil
+}
+
+func (j *jobConfig) validate() error {
+	if j.Query != "" {
+		if err := j.validateQuery(); err != nil {
+			return err
+		}
+	} else if j.Search != "" {
+		if err := j.validateSearch(); err != nil {
+			return err
+		}
+	} else if j.Namespace == "" {
+		return fmt.Errorf("namespace required")
+	}
+	if j.Region != "" && !regionRegexp.MatchString(j.Region) {
+		return fmt.Errorf("invalid region %q", j.Region)
+	}
+	if j.RoleARN != "" {
+		if _, err := roleAccountID(j.RoleARN); err != nil {
+			return err
+		}
+	}
+	if j.Endpoint != "" {
+		if u, err := url.Parse(j.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q", j.Endpoint)
+		}
+	}
+	if j.MetricNameRegex != "" {
+		r, err := regexp.Compile(j.MetricNameRegex)
+		if err != nil {
+			return fmt.Errorf("invalid metric_name_regex: %s", err)
+		}
+		j.metricNameRegexp = r
+	}
+	if j.MetricNameExcludeRegex != "" {
+		r, err := regexp.Compile(j.MetricNameExcludeRegex)
+		if err != nil {
+			return fmt.Errorf("invalid metric_name_exclude_regex: %s", err)
+		}
+		j.metricNameExcludeRegexp = r
+	}
+	j.dimensionRegexps = make(map[string]*regexp.Regexp, len(j.DimensionRegexes))
+	for name, regex := range j.DimensionRegexes {
+		r, err := regexp.Compile(regex)
+		if err != nil {
+			return fmt.Errorf("invalid dimension_regexes for %s: %s", name, err)
+		}
+		j.dimensionRegexps[name] = r
+	}
+	if len(j.Dimensions) > maxDimensionFilters {
+		return fmt.Errorf("too many dimensions, got %d but at most %d are supported", len(j.Dimensions), maxDimensionFilters)
+	}
+	for _, d := range j.Dimensions {
+		if d.Name == "" {
+			return fmt.Errorf("dimension name required")
+		}
+	}
+	stats, err := parseStats(j.Stats)
+	if err != nil {
+		return err
+	}
+	tagKeys, err := parseTagKeys(j.TagKeys)
+	if err != nil {
+		return err
+	}
+	j.TagKeys = tagKeys
+	if err := j.validateTagFilters(); err != nil {
+		return err
+	}
+	if j.BatchSize < 0 || j.BatchSize > maxBatchSize {
+		return fmt.Errorf("batch_size must be between 1 and %d", maxBatchSize)
+	}
+	if j.Concurrency < 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	j.Stats = stats
+	if time.Duration(j.Period)%time.Second != 0 {
+		return fmt.Errorf("period must be a multiple of 1s")
+	}
+	if j.PollInterval != 0 && time.Duration(j.PollInterval) < time.Second {
+		return fmt.Errorf("poll_interval must be at least 1s")
+	}
+	return j.validateExpressions()
+}
+
+// validateExpressions validates the expressions and resolves the metric
+// names they refer to.
+func (j *jobConfig) validateExpressions() error {
+	if len(j.Expressions) == 0 {
+		return nil
+	}
+	if j.Query != "" {
+		return fmt.Errorf("expressions are not supported with query")
+	}
+	for _, name := range j.MetricNames {
+		if name == "*" {
+			return fmt.Errorf("expressions require explicit metric_names")
+		}
+	}
+	defaultStat := "Average"
+	if len(j.Stats) > 0 {
+		defaultStat = j.Stats[0]
+	}
+	j.expressions = make([]expression, len(j.Expressions))
+	names := make(map[string]bool, len(j.Expressions))
+	for i, e := range j.Expressions {
+		if !model.IsValidMetricName(model.LabelValue(e.Name)) {
+			return fmt.Errorf("invalid expression name %q", e.Name)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate expression name %q", e.Name)
+		}
+		names[e.Name] = true
+		refs := expressionReferences(e.Expression, j.MetricNames)
+		if len(refs) == 0 {
+			return fmt.Errorf("expression %s: no metric of metric_names referenced", e.Name)
+		}
+		stat := defaultStat
+		if e.Stat != "" {
+			s, err := parseStat(e.Stat)
+			if err != nil {
+				return fmt.Errorf("expression %s: %s", e.Name, err)
+			}
+			stat = s
+		}
+		j.expressions[i] = expression{
+			name:        e.Name,
+			expression:  e.Expression,
+			stat:        stat,
+			metricNames: refs,
+		}
+	}
+	return nil
+}
+
+// validateQuery validates the settings of Metrics Insights jobs.
+func (j *jobConfig) validateQuery() error {
+	if !model.IsValidMetricName(model.LabelValue(j.QueryMetricName)) {
+		return fmt.Errorf("invalid query_metric_name %q", j.QueryMetricName)
+	}
+	if j.Search != "" {
+		return fmt.Errorf("search is not supported with query")
+	}
+	if len(j.MetricNames) > 0 || len(j.Dimensions) > 0 || len(j.Stats) > 0 {
+		return fmt.Errorf("metric_names, dimensions and stats are not supported with query")
+	}
+	if j.MetricNameRegex != "" || j.MetricNameExcludeRegex != "" || len(j.DimensionRegexes) > 0 {
+		return fmt.Errorf("regular expressions are not supported with query")
+	}
+	return nil
+}
+
+// validateTagFilters validates the tag filters and resolves them.
+func (j *jobConfig) validateTagFilters() error {
+	if len(j.TagFilters) == 0 {
+		return nil
+	}
+	if j.Query != "" || j.Search != "" {
+		return fmt.Errorf("tag_filters are not supported with query or search")
+	}
+	if !tagFiltersSupported(j.Namespace) {
+		return fmt.Errorf("tag_filters are not supported for namespace %s", j.Namespace)
+	}
+	filters := make([]tagFilter, len(j.TagFilters))
+	for i, f := range j.TagFilters {
+		if f.Key == "" {
+			return fmt.Errorf("tag filter key required")
+		}
+		filters[i] = tagFilter{key: f.Key, value: f.Value}
+	}
+	if err := checkTagFilters(filters); err != nil {
+		return err
+	}
+	j.tagFilters = filters
+	return nil
+}
+
+// validateSearch validates the settings of jobs using a search expression.
+func (j *jobConfig) validateSearch() error {
+	namespace, dimensions, err := parseSearchSchema(j.Search)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(j.Search, "'") {
+		return fmt.Errorf("search must not contain single quotes")
+	}
+	if j.Namespace != "" && j.Namespace != namespace {
+		return fmt.Errorf("namespace %s doesn't match search namespace %s", j.Namespace, namespace)
+	}
+	if len(j.MetricNames) > 0 || len(j.Dimensions) > 0 || len(j.Expressions) > 0 {
+		return fmt.Errorf("metric_names, dimensions and expressions are not supported with search")
+	}
+	if j.MetricNameRegex != "" || j.MetricNameExcludeRegex != "" || len(j.DimensionRegexes) > 0 {
+		return fmt.Errorf("regular expressions are not supported with search")
+	}
+	j.searchNamespace = namespace
+	j.searchDimensions = dimensions
+	return nil
+}
+
+// job returns the job with the given name or nil if not found.
+func (c *config) job(name string) *jobConfig {
+	for _, job := range c.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// reporterConfig returns the reporter config for the job. Unset fields are
+// taken from defaults.
+func (j *jobConfig) reporterConfig(defaults reporterConfig) *reporterConfig {
+	config := defaults
+	if j.Region != "" {
+		config.region = j.Region
+	}
+	if j.RoleARN != "" {
+		config.roleARN = j.RoleARN
+		config.externalID = j.ExternalID
+		config.sessionName = j.SessionName
+	}
+	if j.Endpoint != "" {
+		config.endpoint = j.Endpoint
+	}
+	config.namespace = j.Namespace
+	if j.Search != "" {
+		config.namespace = j.searchNamespace
+	}
+	config.search = j.Search
+	config.searchDimensions = j.searchDimensions
+	config.insightsQuery = j.Query
+	config.insightsMetricName = j.QueryMetricName
+	config.metricNames = j.MetricNames
+	if len(config.metricNames) == 0 {
+		config.metricNames = []string{"*"}
+	}
+	config.metricNameRegexp = j.metricNameRegexp
+	config.metricNameExcludeRegexp = j.metricNameExcludeRegexp
+	config.dimensionRegexps = j.dimensionRegexps
+	config.expressions = j.expressions
+	config.tagKeys = j.TagKeys
+	config.tagInfo = j.TagInfo
+	config.tagFilters = j.tagFilters
+	config.dimensions = make([]types.DimensionFilter, len(j.Dimensions))
+	for i, d := range j.Dimensions {
+		config.dimensions[i] = d.filter()
+	}
+	// Jobs only list recently active metrics unless disabled explicitly
+	config.recentlyActive = j.RecentlyActive == nil || *j.RecentlyActive
+	config.stats = j.Stats
+	if len(config.stats) == 0 {
+		config.stats = []string{"Average"}
+	}
+	if j.Period != 0 {
+		config.period = int32(time.Duration(j.Period) / time.Second)
+	}
+	if j.Delay != 0 {
+		config.delayDuration = time.Duration(j.Delay)
+	}
+	if j.Range != 0 {
+		config.rangeDuration = time.Duration(j.Range)
+	}
+	if j.BatchSize != 0 {
+		config.batchSize = j.BatchSize
+	}
+	if j.Concurrency != 0 {
+		config.concurrency = j.Concurrency
+	}
+	return &config
+}
+
+func (d dimensionConfig) filter() types.DimensionFilter {
+	f := types.DimensionFilter{Name: &d.Name}
+	if d.Value != "" {
+		f.Value = &d.Value
+	}
+	return f
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: ec2
+    region: eu-west-1
+    role_arn: arn:aws:iam::123456789012:role/cloudwatch
+    external_id: secret
+    namespace: AWS/EC2
+    metric_names: [NetworkIn, NetworkOut]
+    dimensions:
+      - name: AutoScalingGroupName
+        value: web-prod
+      - name: InstanceId
+    tag_filters:
+      - key: Environment
+        value: production
+    recently_active: false
+    batch_size: 100
+    concurrency: 2
+    stats: [Sum, P99]
+    period: 5m
+    delay: 15m
+    range: 1h
+  - name: glue
+    namespace: Glue
+    metric_name_regex: ^glue\.driver\.s3\.
+    metric_name_exclude_regex: write
+    dimension_regexes:
+      JobName: -prod$
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.job("foo") != nil {
+		t.Fatal("Expected unknown job to be nil")
+	}
+
+	rc := c.job("ec2").reporterConfig(newReporterConfig())
+	if rc.region != "eu-west-1" {
+		t.Fatalf("Expected region eu-west-1 but got %s", rc.region)
+	}
+	if rc.roleARN != "arn:aws:iam::123456789012:role/cloudwatch" || rc.externalID != "secret" {
+		t.Fatalf("Unexpected role %s with external ID %s", rc.roleARN, rc.externalID)
+	}
+	if rc.namespace != "AWS/EC2" {
+		t.Fatalf("Expected namespace AWS/EC2 but got %s", rc.namespace)
+	}
+	if !reflect.DeepEqual(rc.metricNames, []string{"NetworkIn", "NetworkOut"}) {
+		t.Fatalf("Unexpected metric names %v", rc.metricNames)
+	}
+	if !reflect.DeepEqual(rc.stats, []string{"Sum", "p99"}) {
+		t.Fatalf("Unexpected stats %v", rc.stats)
+	}
+	if rc.period != 300 || rc.delayDuration != 15*time.Minute || rc.rangeDuration != time.Hour {
+		t.Fatalf("Unexpected period %d, delay %s or range %s", rc.period, rc.delayDuration, rc.rangeDuration)
+	}
+	if l := len(rc.dimensions); l != 2 {
+		t.Fatalf("Expected 2 dimension filters but got %d", l)
+	}
+	if d := rc.dimensions[0]; *d.Name != "AutoScalingGroupName" || *d.Value != "web-prod" {
+		t.Fatalf("Unexpected dimension filter %s=%s", *d.Name, *d.Value)
+	}
+	if d := rc.dimensions[1]; *d.Name != "InstanceId" || d.Value != nil {
+		t.Fatalf("Expected dimension filter without value but got %s", *d.Value)
+	}
+	if !reflect.DeepEqual(rc.tagFilters, []tagFilter{{key: "Environment", value: "production"}}) {
+		t.Fatalf("Unexpected tag filters %v", rc.tagFilters)
+	}
+	if rc.recentlyActive {
+		t.Fatal("Expected recently_active to be disabled")
+	}
+	if rc.batchSize != 100 || rc.concurrency != 2 {
+		t.Fatalf("Unexpected batch size %d or concurrency %d", rc.batchSize, rc.concurrency)
+	}
+
+	rc = c.job("glue").reporterConfig(newReporterConfig())
+	if !reflect.DeepEqual(rc.metricNames, []string{"*"}) {
+		t.Fatalf("Expected all metric names but got %v", rc.metricNames)
+	}
+	if !reflect.DeepEqual(rc.stats, []string{"Average"}) {
+		t.Fatalf("Expected default stat but got %v", rc.stats)
+	}
+	if !rc.metricNameRegexp.MatchString("glue.driver.s3.filesystem.write_bytes") {
+		t.Fatal("Expected metric name regex to match")
+	}
+	if rc.metricNameExcludeRegexp == nil || rc.dimensionRegexps["JobName"] == nil {
+		t.Fatal("Expected exclude and dimension regexes to be set")
+	}
+	if rc.period != 60 {
+		t.Fatalf("Expected default period but got %d", rc.period)
+	}
+	if !rc.recentlyActive {
+		t.Fatal("Expected recently_active to be enabled by default")
+	}
+	if rc.batchSize != maxBatchSize || rc.concurrency != 10 {
+		t.Fatalf("Expected default batch size and concurrency but got %d and %d", rc.batchSize, rc.concurrency)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, c := range []string{
+		"jobs: [{namespace: AWS/EC2}]",
+		"jobs: [{name: foo}]",
+		"jobs: [{name: foo, namespace: AWS/EC2}, {name: foo, namespace: AWS/EBS}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, metric_name_regex: '('}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, metric_name_exclude_regex: '('}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, dimension_regexes: {JobName: '('}}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, stats: [p101]}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, period: 1500ms}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, dimensions: [{value: foo}]}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, unknown: true}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, region: 'eu west'}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, role_arn: foo}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, endpoint: localhost}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, batch_size: 501}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, concurrency: -1}]",
+		"jobs: [{name: foo, query: 'SELECT AVG(CPUUtilization) FROM \"AWS/EC2\"'}]",
+		"jobs: [{name: foo, query: 'SELECT AVG(CPUUtilization) FROM \"AWS/EC2\"', query_metric_name: cpu, stats: [Sum]}]",
+		"jobs: [{name: foo, namespace: AWS/ELB, expressions: [{name: error_rate, expression: HTTPCode_ELB_5XX / RequestCount}]}]",
+		"jobs: [{name: foo, namespace: AWS/ELB, metric_names: [RequestCount], expressions: [{name: error-rate, expression: RequestCount * 2}]}]",
+		"jobs: [{name: foo, namespace: AWS/ELB, metric_names: [RequestCount], expressions: [{name: requests, expression: RequestCount * 2, stat: foo}]}]",
+		"jobs: [{name: foo, namespace: AWS/ELB, metric_names: [RequestCount], expressions: [{name: requests, expression: RequestCount}, {name: requests, expression: RequestCount}]}]",
+		"jobs: [{name: foo, namespace: AWS/ELB, metric_names: [RequestCount, '*'], expressions: [{name: requests, expression: RequestCount * 2}]}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, tag_keys: [Team, team]}]",
+		"jobs: [{name: foo, namespace: AWS/EC2, tag_filters: [{value: production}]}]",
+		"jobs: [{name: foo, namespace: Custom/App, tag_filters: [{key: Environment}]}]",
+		"jobs: [{name: foo, search: 'MetricName=\"CPUUtilization\"'}]",
+		"jobs: [{name: foo, search: \"{AWS/EC2,InstanceId} MetricName='CPUUtilization'\"}]",
+		"jobs: [{name: foo, namespace: AWS/EBS, search: '{AWS/EC2,InstanceId} CPUUtilization'}]",
+		"jobs: [{name: foo, search: '{AWS/EC2,InstanceId} CPUUtilization', metric_names: [CPUUtilization]}]",
+	} {
+		if _, err := parseConfig([]byte(c)); err == nil {
+			t.Fatalf("Expected error for %q", c)
+		}
+	}
+}
+
+func TestSafeConfigReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "cloudwatch-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	defaults := newReporterConfig()
+	defaults.batchSize = 2
+	var (
+		reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{Name: "reload_success"})
+		reloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{Name: "reload_seconds"})
+		sc            = newSafeConfig(f.Name(), defaults, reloadSuccess, reloadSeconds)
+	)
+	if err := ioutil.WriteFile(f.Name(), []byte("jobs: [{name: ec2, namespace: AWS/EC2}]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.get().job("ec2") == nil {
+		t.Fatal("Expected job ec2 after reload")
+	}
+	if v := testutil.ToFloat64(reloadSuccess); v != 1 {
+		t.Fatalf("Expected reload success 1 but got %f", v)
+	}
+	if v := testutil.ToFloat64(reloadSeconds); v == 0 {
+		t.Fatal("Expected reload timestamp to be set")
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("jobs: [{name: ebs}]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.reload(); err == nil {
+		t.Fatal("Expected error reloading invalid config")
+	}
+	if sc.get().job("ec2") == nil {
+		t.Fatal("Expected previous config to be kept")
+	}
+	if v := testutil.ToFloat64(reloadSuccess); v != 0 {
+		t.Fatalf("Expected reload success 0 but got %f", v)
+	}
+
+	// The statistics must fit into a batch of the job's batch size or the
+	// default one.
+	for _, c := range []string{
+		"jobs: [{name: ebs, namespace: AWS/EBS, batch_size: 1, stats: [Sum, Average]}]",
+		"jobs: [{name: ebs, namespace: AWS/EBS, stats: [Sum, Average, Maximum]}]",
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := sc.reload(); err == nil {
+			t.Fatalf("Expected error reloading %q", c)
+		}
+	}
+	if sc.get().job("ec2") == nil {
+		t.Fatal("Expected previous config to be kept")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stoewer/go-strcase"
+)
+
+// expressionTokenRegexp matches the tokens of a metric math expression that
+// may refer to a metric name.
+var expressionTokenRegexp = regexp.MustCompile(`[A-Za-z0-9_.]+`)
+
+// expression is a metric math expression over metrics with the same
+// dimensions. Metrics are referenced by their metric name.
+type expression struct {
+	name       string
+	expression string
+	// Statistic of the referenced metrics
+	stat string
+	// Metric names referenced by the expression
+	metricNames []string
+}
+
+// expressionReferences returns the metric names out of metricNames referenced
+// by the expression.
+func expressionReferences(expr string, metricNames []string) []string {
+	known := make(map[string]bool, len(metricNames))
+	for _, name := range metricNames {
+		known[name] = true
+	}
+	var (
+		refs = []string{}
+		seen = make(map[string]bool)
+	)
+	for _, token := range expressionTokenRegexp.FindAllString(expr, -1) {
+		if known[token] && !seen[token] {
+			refs = append(refs, token)
+			seen[token] = true
+		}
+	}
+	return refs
+}
+
+// expressionResult maps the result of an expression query back to the
+// expression and the dimensions it was evaluated for.
+type expressionResult struct {
+	expression *expression
+	metric     types.Metric
+}
+
+// dimensionsKey returns a key identifying the namespace and dimensions of m.
+func dimensionsKey(m types.Metric) string {
+	dims := make([]string, len(m.Dimensions))
+	for i, d := range m.Dimensions {
+		dims[i] = aws.ToString(d.Name) + "=" + aws.ToString(d.Value)
+	}
+	sort.Strings(dims)
+	return aws.ToString(m.Namespace) + "\xff" + strings.Join(dims, "\xff")
+}
+
+// groupByDimensions groups the metrics by namespace and dimensions, keeping
+// the order of their first appearance.
+func groupByDimensions(metrics []types.Metric) [][]types.Metric {
+	var (
+		groups = [][]types.Metric{}
+		index  = make(map[string]int)
+	)
+	for _, m := range metrics {
+		key := dimensionsKey(m)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
+// expressionQueries returns the queries evaluating the expressions of the
+// config for each group of metrics with the same dimensions in the batch.
+// The expressions refer to the metric queries built by GetMetricsResults. If
+// the statistic of an expression isn't queried already, the metric is
+// queried additionally without returning its data. The results of the
+// expression query with Id "e<k>" map to results[k].
+func (c *reporter) expressionQueries(metrics []types.Metric) ([]types.MetricDataQuery, []expressionResult) {
+	if len(c.config.expressions) == 0 {
+		return nil, nil
+	}
+	var (
+		ns      = len(c.config.stats)
+		queries = []types.MetricDataQuery{}
+		results = []expressionResult{}
+		// Ids of the hidden queries by metric index and statistic
+		hidden = make(map[string]string)
+		groups = make(map[string]map[string]int)
+		keys   = []string{}
+	)
+	for i, m := range metrics {
+		key := dimensionsKey(m)
+		if groups[key] == nil {
+			groups[key] = make(map[string]int)
+			keys = append(keys, key)
+		}
+		groups[key][aws.ToString(m.MetricName)] = i
+	}
+	for _, key := range keys {
+		group := groups[key]
+	expressions:
+		for e := range c.config.expressions {
+			expr := &c.config.expressions[e]
+			ids := make(map[string]string, len(expr.metricNames))
+			for _, name := range expr.metricNames {
+				i, ok := group[name]
+				if !ok {
+					continue expressions
+				}
+				ids[name] = c.statQueryID(metrics, i, expr.stat, ns, hidden, &queries)
+			}
+			id := "e" + strconv.Itoa(len(results))
+			queries = append(queries, types.MetricDataQuery{
+				Id: aws.String(id),
+				Expression: aws.String(expressionTokenRegexp.ReplaceAllStringFunc(expr.expression, func(token string) string {
+					if id, ok := ids[token]; ok {
+						return id
+					}
+					return token
+				})),
+				Label:      aws.String(expr.name),
+				ReturnData: aws.Bool(true),
+			})
+			results = append(results, expressionResult{
+				expression: expr,
+				metric:     metrics[group[expr.metricNames[0]]],
+			})
+		}
+	}
+	return queries, results
+}
+
+// statQueryID returns the Id of the query for the statistic of metrics[i].
+// Statistics not returned by the job are added to queries as hidden queries.
+func (c *reporter) statQueryID(metrics []types.Metric, i int, stat string, ns int, hidden map[string]string, queries *[]types.MetricDataQuery) string {
+	for j, s := range c.config.stats {
+		if s == stat {
+			return "n" + strconv.Itoa(i*ns+j)
+		}
+	}
+	key := strconv.Itoa(i) + "\xff" + stat
+	if id, ok := hidden[key]; ok {
+		return id
+	}
+	id := "h" + strconv.Itoa(len(hidden))
+	hidden[key] = id
+	*queries = append(*queries, types.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &types.MetricStat{
+			Metric: &metrics[i],
+			Period: &c.config.period,
+			Stat:   aws.String(stat),
+		},
+		ReturnData: aws.Bool(false),
+	})
+	return id
+}
+
+// expressionBatches splits the metrics into batches of at most batchSize
+// queries, keeping metrics with the same dimensions in the same batch so
+// expressions can refer to them.
+func expressionBatches(metrics []types.Metric, config *reporterConfig) [][]types.Metric {
+	var (
+		batches = [][]types.Metric{}
+		batch   = []types.Metric{}
+		size    = 0
+		ne      = len(config.expressions)
+	)
+	for _, group := range groupByDimensions(metrics) {
+		// Upper bound of the queries for the group, assuming each
+		// expression needs a hidden query per metric.
+		n := len(group)*(len(config.stats)+ne) + ne
+		if size > 0 && size+n > config.batchSize {
+			batches = append(batches, batch)
+			batch, size = []types.Metric{}, 0
+		}
+		batch = append(batch, group...)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// collectExpression collects the result of an expression query.
+func (c *collector) collectExpression(ch chan<- prometheus.Metric, r expressionResult, result types.MetricDataResult) {
+	m := r.metric
+	if len(result.Values) == 0 {
+		c.emptyResultsCounter.WithLabelValues(*m.Namespace).Inc()
+		return
+	}
+	var (
+		namespace = strcase.SnakeCase(prometheusMetricNameRegexp.ReplaceAllString(*m.Namespace, "_"))
+		fqName    = namespace + "_" + r.expression.name
+		help      = fmt.Sprintf("Cloudwatch metric math expression %s", r.expression.expression)
+
+		lns = make([]string, len(m.Dimensions))
+		lvs = make([]string, len(m.Dimensions))
+	)
+	for i, d := range m.Dimensions {
+		lns[i] = strcase.SnakeCase(*d.Name)
+		lvs[i] = *d.Value
+	}
+	if c.config.backfill {
+		for i, value := range result.Values {
+			lns, lvs := c.resourceLabels(ch, &m, lns, lvs, result.Timestamps[i])
+			c.sendMetric(ch, fqName, help, lns, lvs, value, result.Timestamps[i])
+		}
+		return
+	}
+	var ts time.Time
+	if len(result.Timestamps) > 0 {
+		ts = result.Timestamps[0]
+	}
+	lns, lvs = c.resourceLabels(ch, &m, lns, lvs, ts)
+	c.sendMetric(ch, fqName, help, lns, lvs, result.Values[0], ts)
+}
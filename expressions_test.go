@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExpressionReferences(t *testing.T) {
+	metricNames := []string{"HTTPCode_Target_5XX_Count", "RequestCount", "glue.driver.aggregate.bytesRead"}
+	for _, tc := range []struct {
+		expression string
+		refs       []string
+	}{
+		{"HTTPCode_Target_5XX_Count / RequestCount", []string{"HTTPCode_Target_5XX_Count", "RequestCount"}},
+		{"100*(HTTPCode_Target_5XX_Count/RequestCount)", []string{"HTTPCode_Target_5XX_Count", "RequestCount"}},
+		{"RATE(RequestCount) + RequestCount", []string{"RequestCount"}},
+		{"glue.driver.aggregate.bytesRead / PERIOD(glue.driver.aggregate.bytesRead)", []string{"glue.driver.aggregate.bytesRead"}},
+		{"RequestCountPerTarget * 2", []string{}},
+	} {
+		if refs := expressionReferences(tc.expression, metricNames); !reflect.DeepEqual(refs, tc.refs) {
+			t.Fatalf("%q: expected %v but got %v", tc.expression, tc.refs, refs)
+		}
+	}
+}
+
+func TestCollectorExpressions(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	for _, lb := range []string{"app/web/1234", "app/api/5678", "app/batch/9012"} {
+		client.Insert("AWS/ApplicationELB", "RequestCount", map[string]string{"LoadBalancer": lb})
+		client.Insert("AWS/ApplicationELB", "HTTPCode_Target_5XX_Count", map[string]string{"LoadBalancer": lb})
+	}
+	// Not referenced by the expression for lack of 5XX errors
+	client.Insert("AWS/ApplicationELB", "RequestCount", map[string]string{"LoadBalancer": "app/idle/3456"})
+
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: alb
+    namespace: AWS/ApplicationELB
+    metric_names: [RequestCount, HTTPCode_Target_5XX_Count]
+    stats: [Average]
+    batch_size: 6
+    expressions:
+      - name: error_ratio
+        expression: HTTPCode_Target_5XX_Count / RequestCount
+        stat: Sum
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.job("alb").reporterConfig(newReporterConfig())
+	collector := newTestCollector(t, client, config)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, mf := range mfs {
+		counts[mf.GetName()] = len(mf.Metric)
+		if mf.GetName() == "cloudwatch_exporter_scrape_success" && mf.Metric[0].GetGauge().GetValue() != 1 {
+			t.Fatal("Expected scrape to succeed")
+		}
+	}
+	for name, count := range map[string]int{
+		"aws_application_elb_request_count_average":              4,
+		"aws_application_elb_http_code_target_5xx_count_average": 3,
+		"aws_application_elb_error_ratio":                        3,
+	} {
+		if counts[name] != count {
+			t.Fatalf("Expected %d series of %s but got %d (%v)", count, name, counts[name], counts)
+		}
+	}
+}
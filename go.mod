@@ -6,7 +6,11 @@ require (
 	github.com/aws/aws-sdk-go v1.27.0
 	github.com/aws/aws-sdk-go-v2 v1.2.1
 	github.com/aws/aws-sdk-go-v2/config v1.1.2
+	github.com/aws/aws-sdk-go-v2/credentials v1.1.2
 	github.com/aws/aws-sdk-go-v2/service/cloudwatch v1.1.2
+	github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi v1.1.0
+	github.com/aws/aws-sdk-go-v2/service/sts v1.1.2
+	github.com/aws/smithy-go v1.2.0
 	github.com/go-kit/kit v0.10.0
 	github.com/golang/protobuf v1.4.2
 	github.com/google/go-cmp v0.5.4
@@ -15,5 +19,8 @@ require (
 	github.com/prometheus/common v0.19.0
 	github.com/prometheus/exporter-toolkit v0.5.1
 	github.com/stoewer/go-strcase v1.2.0
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
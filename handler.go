@@ -1,34 +1,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sync/singleflight"
 )
 
 type handler struct {
 	pathPrefix              string
+	defaults                reporterConfig
+	config                  *safeConfig
 	logger                  log.Logger
 	errorCounter            prometheus.Counter
+	emptyResultsCounter     *prometheus.CounterVec
 	durationSummary         *prometheus.SummaryVec
 	reporterDurationSummary *prometheus.SummaryVec
+	clients                 *clientPool
+	cache                   *listCache
+	group                   singleflight.Group
+	flights                 map[string]*flight
+	flightsLock             sync.Mutex
+	flightID                uint64
+	coalescedCounter        prometheus.Counter
+	timeoutOffset           time.Duration
+	limiter                 concurrencyLimiter
 }
 
-func newHandler(logger log.Logger, pathPrefix string, durationSummary *prometheus.SummaryVec, errorCounter prometheus.Counter, reporterDurationSummary *prometheus.SummaryVec) *handler {
+func newHandler(logger log.Logger, pathPrefix string, defaults reporterConfig, config *safeConfig, durationSummary *prometheus.SummaryVec, errorCounter prometheus.Counter, emptyResultsCounter *prometheus.CounterVec, reporterDurationSummary *prometheus.SummaryVec, clients *clientPool, cache *listCache, coalescedCounter prometheus.Counter, timeoutOffset time.Duration, limiter concurrencyLimiter) *handler {
 	return &handler{
 		pathPrefix:              pathPrefix,
+		defaults:                defaults,
+		config:                  config,
 		logger:                  logger,
 		errorCounter:            errorCounter,
+		emptyResultsCounter:     emptyResultsCounter,
 		durationSummary:         durationSummary,
 		reporterDurationSummary: reporterDurationSummary,
+		clients:                 clients,
+		cache:                   cache,
+		coalescedCounter:        coalescedCounter,
+		timeoutOffset:           timeoutOffset,
+		limiter:                 limiter,
 	}
 }
 
@@ -50,13 +76,8 @@ func (h *handler) parsePath(path string) (string, string) {
 	return namespace, metricName
 }
 
-func configFromQuery(query url.Values) (*reporterConfig, error) {
-	config := &reporterConfig{
-		delayDuration: 600 * time.Second,
-		rangeDuration: 600 * time.Second,
-		period:        60,
-		stat:          "Average",
-	}
+func configFromQuery(defaults reporterConfig, query url.Values) (*reporterConfig, error) {
+	config := &defaults
 	for k, v := range query {
 		if len(v) == 0 {
 			return nil, fmt.Errorf("query parameter %s has no values", k)
@@ -76,13 +97,131 @@ func configFromQuery(query url.Values) (*reporterConfig, error) {
 			case "period":
 				config.period = int32(n)
 			}
+		case "region":
+			if !regionRegexp.MatchString(value) {
+				return nil, fmt.Errorf("invalid region %q", value)
+			}
+			config.region = value
+		case "role_arn":
+			if _, err := roleAccountID(value); err != nil {
+				return nil, err
+			}
+			config.roleARN = value
+		case "external_id":
+			config.externalID = value
+		case "session_name":
+			config.sessionName = value
+		case "dimension":
+			dimensions, err := parseDimensions(v)
+			if err != nil {
+				return nil, err
+			}
+			config.dimensions = dimensions
+		case "metric_name_regex", "metric_name_exclude_regex":
+			r, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			switch k {
+			case "metric_name_regex":
+				config.metricNameRegexp = r
+			case "metric_name_exclude_regex":
+				config.metricNameExcludeRegexp = r
+			}
+		case "dimension_regex":
+			regexps, err := parseDimensionRegexps(v)
+			if err != nil {
+				return nil, err
+			}
+			config.dimensionRegexps = regexps
 		case "stat":
-			config.stat = value
+			stats, err := parseStats(v)
+			if err != nil {
+				return nil, err
+			}
+			config.stats = stats
+		case "tag":
+			filters, err := parseTagFilters(v)
+			if err != nil {
+				return nil, err
+			}
+			config.tagFilters = filters
+		case "tag_key":
+			keys, err := parseTagKeys(v)
+			if err != nil {
+				return nil, err
+			}
+			config.tagKeys = keys
+		case "timestamps", "backfill", "recently_active", "strict", "tag_info":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			switch k {
+			case "timestamps":
+				config.timestamps = b
+			case "backfill":
+				config.backfill = b
+			case "recently_active":
+				config.recentlyActive = b
+			case "strict":
+				config.strict = b
+			case "tag_info":
+				config.tagInfo = b
+			}
 		}
 	}
+	// Backfilled samples are meaningless without their timestamps.
+	if config.backfill {
+		config.timestamps = true
+	}
+	if len(config.stats) == 0 {
+		config.stats = []string{"Average"}
+	}
+	if err := config.validateBatchSize(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
+// parseDimensions returns the dimension filters for the given dimension query
+// parameter values of the form Name=Value or Name.
+func parseDimensions(values []string) ([]types.DimensionFilter, error) {
+	if len(values) > maxDimensionFilters {
+		return nil, fmt.Errorf("too many dimensions, got %d but at most %d are supported", len(values), maxDimensionFilters)
+	}
+	dimensions := make([]types.DimensionFilter, len(values))
+	for i, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid dimension %q", value)
+		}
+		dimensions[i] = dimensionConfig{Name: parts[0]}.filter()
+		if len(parts) == 2 {
+			dimensions[i] = dimensionConfig{Name: parts[0], Value: parts[1]}.filter()
+		}
+	}
+	return dimensions, nil
+}
+
+// parseDimensionRegexps returns the dimension value regexps for the given
+// dimension_regex query parameter values of the form Name=Regexp.
+func parseDimensionRegexps(values []string) (map[string]*regexp.Regexp, error) {
+	regexps := make(map[string]*regexp.Regexp, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid dimension regex %q", value)
+		}
+		r, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		regexps[parts[0]] = r
+	}
+	return regexps, nil
+}
+
 // ServeHTTP implements http.Handler.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -101,25 +240,222 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	logger := log.With(h.logger, "namespace", namespace, "metric", metricName)
 
-	config, err := configFromQuery(r.URL.Query())
+	config, err := configFromQuery(h.defaults, r.URL.Query())
 	if err != nil {
 		h.errorCounter.Inc()
 		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	reporter, err := newReporter(h.logger, config, h.reporterDurationSummary)
+	config.namespace = namespace
+	config.metricNames = []string{metricName}
+	if err := config.validateTagFilters(); err != nil {
+		h.errorCounter.Inc()
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.serve(w, r, logger, config)
+	h.durationSummary.WithLabelValues(namespace, metricName).Observe(time.Since(start).Seconds())
+}
+
+// serveProbe serves the metrics for the job given by the job query
+// parameter. Other query parameters override the job config.
+func (h *handler) serveProbe(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	level.Debug(h.logger).Log("msg", "got probe request", "query", r.URL.RawQuery)
+
+	name := r.URL.Query().Get("job")
+	if name == "" {
+		h.errorCounter.Inc()
+		http.Error(w, "Job required", http.StatusBadRequest)
+		return
+	}
+	job := h.config.get().job(name)
+	if job == nil {
+		h.errorCounter.Inc()
+		http.Error(w, "Unknown job "+name, http.StatusNotFound)
+		return
+	}
+	logger := log.With(h.logger, "job", name)
+
+	config, err := configFromQuery(*job.reporterConfig(h.defaults), r.URL.Query())
+	if err == nil {
+		err = config.validateTagFilters()
+	}
 	if err != nil {
 		h.errorCounter.Inc()
-		level.Error(h.logger).Log("msg", "Couldn't create reporter", "err", err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	reporter.namespace = namespace   // FIXME
-	reporter.metricName = metricName // FIXME
-	c := newCollector(logger, reporter, h.errorCounter)
+	h.serve(w, r, logger, config)
+	h.durationSummary.WithLabelValues(config.namespace, config.metricNamesLabel()).Observe(time.Since(start).Seconds())
+}
 
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(c)
-	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-	h.durationSummary.WithLabelValues(namespace, metricName).Observe(time.Since(start).Seconds())
+// newCollector returns a collector for the given config.
+func (h *handler) newCollector(ctx context.Context, logger log.Logger, config *reporterConfig) (*collector, error) {
+	reporter, err := newReporter(ctx, h.logger, config, h.reporterDurationSummary, h.clients, h.cache)
+	if err != nil {
+		return nil, err
+	}
+	return newCollector(ctx, logger, reporter, h.errorCounter, h.emptyResultsCounter, h.limiter), nil
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request, logger log.Logger, config *reporterConfig) {
+	ctx, cancel := h.scrapeContext(r)
+	defer cancel()
+
+	// Identical requests share the result of a single collection.
+	key := r.URL.Path + "?" + r.URL.Query().Encode()
+	g := h.coalesce(ctx, key, func(ctx context.Context) (prometheus.Gatherer, error) {
+		c, err := h.newCollector(ctx, logger, config)
+		if err != nil {
+			h.errorCounter.Inc()
+			level.Error(h.logger).Log("msg", "Couldn't create reporter", "err", err.Error())
+			return nil, err
+		}
+		if config.backfill {
+			return backfillGatherer{c}, nil
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(c)
+		return registry, nil
+	})
+	if config.backfill {
+		if err := serveBackfill(w, g); err != nil {
+			h.errorCounter.Inc()
+			level.Error(logger).Log("msg", "Couldn't serve backfill", "err", err.Error())
+		}
+		return
+	}
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeContext returns the context of the request. If Prometheus sent its
+// scrape timeout, the context is canceled the timeout offset before that, so
+// partial results can be returned in time.
+func (h *handler) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return context.WithCancel(r.Context())
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		level.Warn(h.logger).Log("msg", "Couldn't parse scrape timeout", "timeout", v, "err", err)
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > h.timeoutOffset {
+		timeout -= h.timeoutOffset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// flight is a collection shared by coalesced requests. It runs on its own
+// context, so it isn't canceled when one of the requests goes away. The
+// context is canceled at the latest deadline of the waiting requests or when
+// all of them are gone.
+type flight struct {
+	id       uint64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	waiters  int
+	deadline time.Time   // latest deadline of the waiters
+	timer    *time.Timer // cancels the flight at the deadline
+	// Whether a waiter has no deadline
+	unbounded bool
+}
+
+// join adds a request with the context ctx to the flight for key. A new
+// flight is started if there is none or the current one was canceled.
+func (h *handler) join(ctx context.Context, key string) *flight {
+	h.flightsLock.Lock()
+	defer h.flightsLock.Unlock()
+	if h.flights == nil {
+		h.flights = make(map[string]*flight)
+	}
+	f, ok := h.flights[key]
+	if !ok || f.ctx.Err() != nil {
+		h.flightID++
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{id: h.flightID, ctx: fctx, cancel: cancel}
+		h.flights[key] = f
+	}
+	f.waiters++
+	deadline, ok := ctx.Deadline()
+	switch {
+	case !ok:
+		f.unbounded = true
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+	case f.unbounded:
+	case f.timer == nil:
+		f.deadline = deadline
+		f.timer = time.AfterFunc(time.Until(deadline), f.cancel)
+	case deadline.After(f.deadline):
+		f.deadline = deadline
+		f.timer.Reset(time.Until(deadline))
+	}
+	return f
+}
+
+// leave removes a request from the flight. The flight is canceled when the
+// last request leaves.
+func (h *handler) leave(key string, f *flight) {
+	h.flightsLock.Lock()
+	defer h.flightsLock.Unlock()
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	if h.flights[key] == f {
+		delete(h.flights, key)
+	}
+}
+
+// outlives returns whether the flight runs past the deadline of ctx.
+func (h *handler) outlives(f *flight, ctx context.Context) bool {
+	h.flightsLock.Lock()
+	defer h.flightsLock.Unlock()
+	deadline, _ := ctx.Deadline()
+	return f.unbounded || f.deadline.After(deadline)
+}
+
+// coalesce returns a gatherer that shares the result of a single collection
+// with all concurrent calls for the same key. Only one of them creates a
+// gatherer with newGatherer, on the context of the flight they joined.
+// Requests stop waiting when their context is done, unless the flight is
+// canceled at the same time and returns partial results.
+func (h *handler) coalesce(ctx context.Context, key string, newGatherer func(context.Context) (prometheus.Gatherer, error)) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		f := h.join(ctx, key)
+		defer h.leave(key, f)
+		ch := h.group.DoChan(key+"\xff"+strconv.FormatUint(f.id, 10), func() (interface{}, error) {
+			g, err := newGatherer(f.ctx)
+			if err != nil {
+				return nil, err
+			}
+			return g.Gather()
+		})
+		done := ctx.Done()
+		for {
+			select {
+			case res := <-ch:
+				if res.Shared {
+					h.coalescedCounter.Inc()
+				}
+				mfs, _ := res.Val.([]*dto.MetricFamily)
+				return mfs, res.Err
+			case <-done:
+				if ctx.Err() == context.DeadlineExceeded && !h.outlives(f, ctx) {
+					done = nil
+					continue
+				}
+				return nil, ctx.Err()
+			}
+		}
+	})
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConfigFromQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query      string
+		stats      []string
+		timestamps bool
+		err        bool
+	}{
+		{"", []string{"Average"}, false, false},
+		{"stat=Sum", []string{"Sum"}, false, false},
+		{"stat=Sum&stat=Maximum&stat=p99", []string{"Sum", "Maximum", "p99"}, false, false},
+		{"stat=Sum,Maximum&stat=p99", []string{"Sum", "Maximum", "p99"}, false, false},
+		{"stat=Sum,,Sum&stat=Sum", []string{"Sum"}, false, false},
+		{"stat=sum,P99.9", []string{"Sum", "p99.9"}, false, false},
+		{"timestamps=true", []string{"Average"}, true, false},
+		{"stat=p101", nil, false, true},
+		{"period=foo", nil, false, true},
+		{"timestamps=foo", nil, false, true},
+		{"region=eu-west-1", []string{"Average"}, false, false},
+		{"region=us-gov-east-1", []string{"Average"}, false, false},
+		{"region=example.com/", nil, false, true},
+		{"role_arn=arn:aws:iam::123456789012:role/cloudwatch&external_id=foo", []string{"Average"}, false, false},
+		{"role_arn=foo", nil, false, true},
+		{"dimension=AutoScalingGroupName=web-prod&dimension=InstanceId", []string{"Average"}, false, false},
+		{"dimension==foo", nil, false, true},
+		{"metric_name_regex=(", nil, false, true},
+		{"dimension_regex=InstanceId", nil, false, true},
+		{"recently_active=true", []string{"Average"}, false, false},
+		{"recently_active=foo", nil, false, true},
+		{"strict=true", []string{"Average"}, false, false},
+		{"tag_key=Team,Environment&tag_info=true", []string{"Average"}, false, false},
+		{"tag_key=cost-center&tag_key=cost_center", nil, false, true},
+		{"tag_info=foo", nil, false, true},
+		{"tag=Environment=production&tag=Team", []string{"Average"}, false, false},
+		{"tag==production", nil, false, true},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := configFromQuery(newReporterConfig(), query)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.query, err)
+		}
+		if !reflect.DeepEqual(config.stats, tc.stats) {
+			t.Fatalf("%q: expected stats %v but got %v", tc.query, tc.stats, config.stats)
+		}
+		if config.timestamps != tc.timestamps {
+			t.Fatalf("%q: expected timestamps %t but got %t", tc.query, tc.timestamps, config.timestamps)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var (
+		h = &handler{
+			coalescedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "cloudwatch_exporter_coalesced_requests_total",
+				Help: "Number of coalesced requests.",
+			}),
+		}
+		started = make(chan struct{})
+		release = make(chan struct{})
+		calls   int32
+	)
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return []*dto.MetricFamily{{Name: proto.String("foo")}}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mfs, err := h.coalesce(context.Background(), "/metrics/AWS/EC2/*?stat=Sum", func(context.Context) (prometheus.Gatherer, error) {
+				return g, nil
+			}).Gather()
+			if err != nil || len(mfs) != 1 {
+				t.Errorf("Unexpected result %v, %v", mfs, err)
+			}
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	// Give the other requests time to join the running one.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("Expected 1 gather call but got %d", c)
+	}
+	if c := testutil.ToFloat64(h.coalescedCounter); c != 3 {
+		t.Fatalf("Expected 3 coalesced requests but got %v", c)
+	}
+}
+
+func TestCoalesceContext(t *testing.T) {
+	var (
+		h = &handler{
+			coalescedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "cloudwatch_exporter_coalesced_requests_total",
+				Help: "Number of coalesced requests.",
+			}),
+		}
+		key     = "/metrics/AWS/EC2/*?stat=Sum"
+		started = make(chan context.Context)
+		release = make(chan struct{})
+	)
+	newGatherer := func(ctx context.Context) (prometheus.Gatherer, error) {
+		return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			started <- ctx
+			<-release
+			return []*dto.MetricFamily{{Name: proto.String("foo")}}, ctx.Err()
+		}), nil
+	}
+
+	// The collection outlives the request that started it.
+	first, cancelFirst := context.WithTimeout(context.Background(), time.Minute)
+	firstDone := make(chan error)
+	go func() {
+		_, err := h.coalesce(first, key, newGatherer).Gather()
+		firstDone <- err
+	}()
+	ctx := <-started
+	second, cancelSecond := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelSecond()
+	secondDone := make(chan error)
+	go func() {
+		mfs, err := h.coalesce(second, key, newGatherer).Gather()
+		if err == nil && len(mfs) != 1 {
+			err = fmt.Errorf("unexpected result %v", mfs)
+		}
+		secondDone <- err
+	}()
+	for {
+		h.flightsLock.Lock()
+		waiters := h.flights[key].waiters
+		h.flightsLock.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if deadline, _ := ctx.Deadline(); !deadline.IsZero() {
+		t.Fatalf("Expected the collection to have no deadline of its own but got %s", deadline)
+	}
+	h.flightsLock.Lock()
+	if d, _ := second.Deadline(); !h.flights[key].deadline.Equal(d) {
+		t.Fatalf("Expected the collection to be canceled at the latest deadline %s but got %s", d, h.flights[key].deadline)
+	}
+	h.flightsLock.Unlock()
+	cancelFirst()
+	if err := <-firstDone; err != context.Canceled {
+		t.Fatalf("Expected canceled request but got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Expected the collection to continue for the remaining request")
+	}
+	close(release)
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection is canceled once all requests are gone.
+	release = make(chan struct{})
+	third, cancelThird := context.WithCancel(context.Background())
+	thirdDone := make(chan error)
+	go func() {
+		_, err := h.coalesce(third, key, newGatherer).Gather()
+		thirdDone <- err
+	}()
+	ctx = <-started
+	cancelThird()
+	<-thirdDone
+	if ctx.Err() == nil {
+		t.Fatal("Expected the collection to be canceled without requests")
+	}
+	close(release)
+}
+
+func TestServeHTTPTagFilters(t *testing.T) {
+	h := &handler{
+		pathPrefix: "/metrics/",
+		defaults:   newReporterConfig(),
+		logger:     log.NewNopLogger(),
+		errorCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_errors_total",
+			Help: "Number of errors.",
+		}),
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/Custom/App/Requests?tag=Team=web", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for tag filters on unsupported namespace but got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	h := &handler{logger: log.NewNopLogger(), timeoutOffset: 500 * time.Millisecond}
+	for _, tc := range []struct {
+		header  string
+		timeout time.Duration // 0 for no deadline
+	}{
+		{"", 0},
+		{"foo", 0},
+		{"10", 9500 * time.Millisecond},
+		{"0.25", 250 * time.Millisecond},
+	} {
+		r := httptest.NewRequest("GET", "/metrics/AWS/EC2/*", nil)
+		if tc.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+		}
+		ctx, cancel := h.scrapeContext(r)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if ok != (tc.timeout != 0) {
+			t.Fatalf("%q: expected deadline %t but got %t", tc.header, tc.timeout != 0, ok)
+		}
+		if !ok {
+			continue
+		}
+		if d := time.Until(deadline); d > tc.timeout || d < tc.timeout-time.Second {
+			t.Fatalf("%q: expected timeout %s but got %s", tc.header, tc.timeout, d)
+		}
+	}
+}
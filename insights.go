@@ -0,0 +1,119 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stoewer/go-strcase"
+)
+
+// groupByRegexp matches the GROUP BY clause of a Metrics Insights query.
+var groupByRegexp = regexp.MustCompile(`(?is)\bGROUP\s+BY\s+(.+?)(?:\s+ORDER\s+BY\b.*|\s+LIMIT\b.*)?$`)
+
+// parseGroupBy returns the GROUP BY keys of the given Metrics Insights query.
+func parseGroupBy(query string) []string {
+	m := groupByRegexp.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return nil
+	}
+	keys := strings.Split(m[1], ",")
+	for i, key := range keys {
+		keys[i] = strings.Trim(strings.TrimSpace(key), `"`)
+	}
+	return keys
+}
+
+// labelSeparator separates the property values in the labels of the time
+// series. Unlike spaces, control characters can't be part of the values.
+const labelSeparator = "\x1f"
+
+// dynamicLabel returns the label template making CloudWatch label each time
+// series with the values of the given properties, like Dim.InstanceId,
+// separated by labelSeparator.
+func dynamicLabel(props []string) string {
+	parts := make([]string, len(props))
+	for i, prop := range props {
+		parts[i] = "${PROP('" + prop + "')}"
+	}
+	return strings.Join(parts, labelSeparator)
+}
+
+// splitLabel returns the n property values of a label set by dynamicLabel.
+// It returns false if the label doesn't contain exactly n values.
+func splitLabel(label string, n int) ([]string, bool) {
+	values := strings.Split(label, labelSeparator)
+	return values, len(values) == n
+}
+
+// insightsLabel returns the label template for the results of a query
+// grouped by keys.
+func insightsLabel(keys []string) string {
+	props := make([]string, len(keys))
+	for i, key := range keys {
+		props[i] = "Dim." + key
+	}
+	return dynamicLabel(props)
+}
+
+// insightsLabels returns the label names and values for a time series
+// returned by a query grouped by keys and labeled with insightsLabel. It
+// returns false if the label doesn't match the keys.
+func insightsLabels(keys []string, label string) ([]string, []string, bool) {
+	if len(keys) == 0 {
+		return []string{}, []string{}, true
+	}
+	lvs, ok := splitLabel(label, len(keys))
+	if !ok {
+		return nil, nil, false
+	}
+	lns := make([]string, len(keys))
+	for i, key := range keys {
+		lns[i] = strcase.SnakeCase(prometheusMetricNameRegexp.ReplaceAllString(key, "_"))
+	}
+	return lns, lvs, true
+}
+
+// collectInsights collects the results of the Metrics Insights query.
+func (c *collector) collectInsights(ch chan<- prometheus.Metric) {
+	results, err := c.reporter.GetInsightsResults(c.ctx)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			atomic.StoreUint32(&c.deadlineExceeded, 1)
+			return
+		}
+		level.Error(c.logger).Log("msg", "failed to get insights results", "err", err)
+		c.batchFailed(ch, errorReason(err), err)
+		return
+	}
+	var (
+		keys = parseGroupBy(c.config.insightsQuery)
+		help = "Cloudwatch Metrics Insights query " + c.config.insightsQuery
+	)
+	for _, result := range results {
+		if len(result.Values) == 0 {
+			c.emptyResultsCounter.WithLabelValues(c.config.namespace).Inc()
+			continue
+		}
+		lns, lvs, ok := insightsLabels(keys, aws.ToString(result.Label))
+		if !ok {
+			level.Warn(c.logger).Log("msg", "Skipping insights result with unexpected label", "label", aws.ToString(result.Label), "keys", strings.Join(keys, ","))
+			continue
+		}
+		if c.config.backfill {
+			for i, value := range result.Values {
+				c.sendMetric(ch, c.config.insightsMetricName, help, lns, lvs, value, result.Timestamps[i])
+			}
+			continue
+		}
+		var ts time.Time
+		if len(result.Timestamps) > 0 {
+			ts = result.Timestamps[0]
+		}
+		c.sendMetric(ch, c.config.insightsMetricName, help, lns, lvs, result.Values[0], ts)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		keys  []string
+	}{
+		{`SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId)`, nil},
+		{`SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId) GROUP BY InstanceId`, []string{"InstanceId"}},
+		{`SELECT SUM(RequestCount) FROM "AWS/ApplicationELB" GROUP BY LoadBalancer, "AvailabilityZone" ORDER BY SUM() DESC LIMIT 10`, []string{"LoadBalancer", "AvailabilityZone"}},
+		{"select max(CPUUtilization) from \"AWS/EC2\"\ngroup by AutoScalingGroupName\nlimit 5", []string{"AutoScalingGroupName"}},
+	} {
+		if keys := parseGroupBy(tc.query); !reflect.DeepEqual(keys, tc.keys) {
+			t.Fatalf("%q: expected %v but got %v", tc.query, tc.keys, keys)
+		}
+	}
+}
+
+func TestInsightsLabels(t *testing.T) {
+	keys := []string{"LoadBalancer", "AvailabilityZone"}
+	if label := insightsLabel(keys); label != "${PROP('Dim.LoadBalancer')}\x1f${PROP('Dim.AvailabilityZone')}" {
+		t.Fatalf("Unexpected label template %q", label)
+	}
+	for _, tc := range []struct {
+		keys  []string
+		label string
+		lvs   []string
+		ok    bool
+	}{
+		{keys, "app/web 1234\x1feu-west-1a", []string{"app/web 1234", "eu-west-1a"}, true},
+		{keys, "\x1feu-west-1a", []string{"", "eu-west-1a"}, true},
+		{keys, "app/web 1234 eu-west-1a", nil, false},
+		{keys, "a\x1fb\x1fc", nil, false},
+		{nil, "Other", []string{}, true},
+	} {
+		_, lvs, ok := insightsLabels(tc.keys, tc.label)
+		if ok != tc.ok || !reflect.DeepEqual(lvs, tc.lvs) {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", tc.label, tc.lvs, tc.ok, lvs, ok)
+		}
+	}
+}
+
+func TestCollectorInsights(t *testing.T) {
+	query := `SELECT SUM(RequestCount) FROM "AWS/ApplicationELB" GROUP BY LoadBalancer, AvailabilityZone`
+	client := mock.NewCloudwatchAPIClient()
+	client.InsertExpression(query,
+		"app/web/1234"+labelSeparator+"eu-west-1a",
+		"app/web/1234"+labelSeparator+"eu-west-1b",
+		"app/api/5678"+labelSeparator+"eu-west-1a",
+		"Other", // not matching the keys
+	)
+
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: alb
+    query: ` + query + `
+    query_metric_name: aws_applicationelb_request_count_sum
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.job("alb").reporterConfig(newReporterConfig())
+	config.rangeDuration = 5 * time.Minute
+	collector := newTestCollector(t, client, config)
+	collector.region = "eu-west-1"
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "aws_applicationelb_request_count_sum" {
+			continue
+		}
+		found = true
+		if l := len(mf.Metric); l != 3 {
+			t.Fatalf("Expected 3 time series but got %d", l)
+		}
+		m := mf.Metric[0]
+		if lb, az := labelValue(m, "load_balancer"), labelValue(m, "availability_zone"); lb != "app/api/5678" || az != "eu-west-1a" {
+			t.Fatalf("Unexpected labels load_balancer=%q availability_zone=%q", lb, az)
+		}
+		if r := labelValue(m, "region"); r != "eu-west-1" {
+			t.Fatalf("Expected region label but got %q", r)
+		}
+	}
+	if !found {
+		t.Fatal("Expected query results")
+	}
+}
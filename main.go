@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -48,6 +53,66 @@ func main() {
 			"web.telemetry-path",
 			"Path prefix under which to expose metrics.",
 		).Default("/metrics").String()
+		configFile = kingpin.Flag(
+			"config.file",
+			"Path to configuration file with scrape jobs served on /probe.",
+		).Default("").String()
+		timestamps = kingpin.Flag(
+			"cloudwatch.timestamps",
+			"Expose metrics with the CloudWatch timestamp instead of the scrape time by default.",
+		).Default("false").Bool()
+		listMetricsCacheTTL = kingpin.Flag(
+			"cloudwatch.list-metrics-cache-ttl",
+			"How long to cache ListMetrics results. Set to 0 to disable the cache.",
+		).Default("5m").Duration()
+		tagsCacheTTL = kingpin.Flag(
+			"tags.cache-ttl",
+			"How long to cache resource tags from the Resource Groups Tagging API. Set to 0 to look up the tags on every scrape.",
+		).Default("5m").Duration()
+		timeoutOffset = kingpin.Flag(
+			"web.timeout-offset",
+			"Offset to subtract from the scrape timeout sent by Prometheus, to leave time for returning partial results.",
+		).Default("0.5s").Duration()
+		retryMaxAttempts = kingpin.Flag(
+			"cloudwatch.retry.max-attempts",
+			"Maximum number of attempts per CloudWatch API call, including the first one.",
+		).Default("3").Int()
+		retryBaseDelay = kingpin.Flag(
+			"cloudwatch.retry.base-delay",
+			"Delay before the first retry, doubled with every further retry.",
+		).Default("500ms").Duration()
+		retryMaxDelay = kingpin.Flag(
+			"cloudwatch.retry.max-delay",
+			"Maximum delay between retries.",
+		).Default("10s").Duration()
+		retryJitter = kingpin.Flag(
+			"cloudwatch.retry.jitter",
+			"Fraction of the retry delay to randomize, between 0 and 1.",
+		).Default("0.5").Float64()
+		listMetricsRate = kingpin.Flag(
+			"cloudwatch.list-metrics-rate",
+			"Maximum ListMetrics calls per second per account and region. Set to 0 to disable the limit.",
+		).Default("25").Float64()
+		getMetricDataRate = kingpin.Flag(
+			"cloudwatch.get-metric-data-rate",
+			"Maximum GetMetricData calls per second per account and region. Set to 0 to disable the limit.",
+		).Default("50").Float64()
+		getResourcesRate = kingpin.Flag(
+			"tags.get-resources-rate",
+			"Maximum GetResources calls per second per account and region. Set to 0 to disable the limit.",
+		).Default("5").Float64()
+		batchSize = kingpin.Flag(
+			"cloudwatch.batch-size",
+			"Number of queries per GetMetricData call, at most 500.",
+		).Default("500").Int()
+		concurrency = kingpin.Flag(
+			"cloudwatch.concurrency",
+			"Number of concurrent GetMetricData calls per request.",
+		).Default("10").Int()
+		maxConcurrency = kingpin.Flag(
+			"cloudwatch.max-concurrency",
+			"Number of concurrent GetMetricData calls across all requests. Set to 0 for no limit.",
+		).Default("0").Int()
 		tlsConfig = kingpin.Flag(
 			"web.config",
 			"[EXPERIMENTAL] Path to config yaml file that can enable TLS or authentication.",
@@ -65,6 +130,38 @@ func main() {
 			Name: "cloudwatch_errors_total",
 			Help: "Number of errors.",
 		})
+		emptyResultsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_metrics_without_datapoints_total",
+			Help: "Number of queried metrics that returned no data points.",
+		}, []string{"metric_namespace"})
+		coalescedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_coalesced_requests_total",
+			Help: "Number of requests that shared a collection with concurrent identical requests.",
+		})
+		retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_api_retries_total",
+			Help: "Number of retried AWS API calls by error code.",
+		}, []string{"api_call", "code"})
+		rateLimiterWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "cloudwatch_exporter_rate_limiter_wait_seconds",
+			Help: "Time AWS API calls waited for the rate limiter.",
+		}, []string{"api_call"})
+		cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_list_metrics_cache_hits_total",
+			Help: "Number of ListMetrics results served from the cache.",
+		})
+		cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_exporter_list_metrics_cache_misses_total",
+			Help: "Number of ListMetrics results not found in the cache.",
+		})
+		reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		})
+		reloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		})
 	)
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
@@ -72,23 +169,123 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	logger := promlog.New(promlogConfig)
+	if *retryMaxAttempts < 1 {
+		level.Error(logger).Log("msg", "--cloudwatch.retry.max-attempts must be at least 1")
+		os.Exit(1)
+	}
+	if *batchSize < 1 || *batchSize > maxBatchSize {
+		level.Error(logger).Log("msg", fmt.Sprintf("--cloudwatch.batch-size must be between 1 and %d", maxBatchSize))
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		level.Error(logger).Log("msg", "--cloudwatch.concurrency must be at least 1")
+		os.Exit(1)
+	}
+	if *retryJitter < 0 || *retryJitter > 1 {
+		level.Error(logger).Log("msg", "--cloudwatch.retry.jitter must be between 0 and 1")
+		os.Exit(1)
+	}
 
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(durationSummary)
 	registry.MustRegister(reporterDurationSummary)
 	registry.MustRegister(errorCounter)
+	registry.MustRegister(emptyResultsCounter)
+	registry.MustRegister(coalescedCounter)
+	registry.MustRegister(retriesCounter)
+	registry.MustRegister(rateLimiterWait)
+	registry.MustRegister(reloadSuccess)
+	registry.MustRegister(reloadSeconds)
+
+	var cache *listCache
+	if *listMetricsCacheTTL > 0 {
+		cache = newListCache(logger, *listMetricsCacheTTL, cacheHits, cacheMisses)
+		registry.MustRegister(cacheHits)
+		registry.MustRegister(cacheMisses)
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_list_metrics_cache_entries",
+			Help: "Number of cached ListMetrics results.",
+		}, cache.len))
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_list_metrics_cache_max_age_seconds",
+			Help: "Age of the oldest cached ListMetrics result.",
+		}, cache.maxAge))
+	}
+
+	defaults := newReporterConfig()
+	defaults.timestamps = *timestamps
+	defaults.batchSize = *batchSize
+	defaults.concurrency = *concurrency
+	sc := newSafeConfig(*configFile, defaults, reloadSuccess, reloadSeconds)
+	h := newHandler(logger, *metricsPath, defaults, sc, durationSummary, errorCounter, emptyResultsCounter, reporterDurationSummary, newClientPool(retryPolicy{
+		maxAttempts: *retryMaxAttempts,
+		baseDelay:   *retryBaseDelay,
+		maxDelay:    *retryMaxDelay,
+		jitter:      *retryJitter,
+	}, retriesCounter, rateLimits{
+		listMetrics:   *listMetricsRate,
+		getMetricData: *getMetricDataRate,
+		getResources:  *getResourcesRate,
+	}, rateLimiterWait, *tagsCacheTTL), cache, coalescedCounter, *timeoutOffset, newConcurrencyLimiter(*maxConcurrency))
+	p := newPoller(logger, defaults, h.newCollector, errorCounter)
+	// Reloads triggered by SIGHUP and /-/reload must not interleave, or the
+	// poller could end up polling the jobs of an older config.
+	var reloadLock sync.Mutex
+	reload := func() error {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		if err := sc.reload(); err != nil {
+			return err
+		}
+		p.update(sc.get())
+		return nil
+	}
+	if *configFile != "" {
+		if err := reload(); err != nil {
+			level.Error(logger).Log("msg", "Couldn't load config file", "file", *configFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				level.Error(logger).Log("msg", "Couldn't reload config file", "file", *configFile, "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded config file", "file", *configFile)
+		}
+	}()
 
 	var (
 		telemetryMux    = http.NewServeMux()
 		telemetryServer = http.Server{Handler: telemetryMux, Addr: *telemetryListenAddress}
 	)
 	telemetryMux.Handle(*telemetryMetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: promLogger{logger}}))
+	telemetryMux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "This endpoint requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			level.Error(logger).Log("msg", "Couldn't reload config file", "file", *configFile, "err", err)
+			http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		level.Info(logger).Log("msg", "Reloaded config file", "file", *configFile)
+	})
 
 	var (
 		metricsMux    = http.NewServeMux()
 		metricsServer = http.Server{Handler: metricsMux, Addr: *listenAddress}
 	)
-	metricsMux.Handle(*metricsPath, newHandler(logger, *metricsPath, durationSummary, errorCounter, reporterDurationSummary))
+	metricsMux.Handle(*metricsPath, h)
+	metricsMux.Handle(strings.TrimSuffix(*metricsPath, "/"), promhttp.HandlerFor(p, promhttp.HandlerOpts{
+		ErrorLog:      promLogger{logger},
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
+	metricsMux.HandleFunc("/probe", h.serveProbe)
 	metricsMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Cloudwatch Exporter</title></head>
@@ -3,25 +3,41 @@ package mock
 import (
 	"context"
 	"reflect"
+	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/smithy-go"
 )
 
+// queryIDRegexp matches the query ids used by the exporter.
+var queryIDRegexp = regexp.MustCompile(`\b[a-z][0-9]+\b`)
+
 type CloudwatchAPIClient struct {
 	cloudwatch.ListMetricsAPIClient
 	cloudwatch.GetMetricDataAPIClient
 
 	batchSize int
 	metrics   map[string]map[string][]types.Metric
+	// Metrics without data points, neither returned by GetMetricData nor
+	// listed when RecentlyActive is set
+	inactive map[string]bool
+	// Errors returned by GetMetricData when querying a metric
+	errors map[string]error
+	// Labels of the time series returned by expressions
+	expressions map[string][]string
 }
 
 func NewCloudwatchAPIClient() *CloudwatchAPIClient {
 	return &CloudwatchAPIClient{
-		batchSize: 500,
-		metrics:   make(map[string]map[string][]types.Metric),
+		batchSize:   500,
+		metrics:     make(map[string]map[string][]types.Metric),
+		inactive:    make(map[string]bool),
+		errors:      make(map[string]error),
+		expressions: make(map[string][]string),
 	}
 }
 
@@ -45,6 +61,36 @@ func (c *CloudwatchAPIClient) getMetrics(namespace, name *string) []types.Metric
 	return c.metrics[*namespace][*name]
 }
 
+// filterDimensions returns the metrics matching all dimension filters.
+func filterDimensions(metrics []types.Metric, filters []types.DimensionFilter) []types.Metric {
+	if len(filters) == 0 {
+		return metrics
+	}
+	filtered := []types.Metric{}
+	for _, m := range metrics {
+		if matchDimensions(m, filters) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func matchDimensions(m types.Metric, filters []types.DimensionFilter) bool {
+	for _, f := range filters {
+		found := false
+		for _, d := range m.Dimensions {
+			if *d.Name == *f.Name && (f.Value == nil || *d.Value == *f.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *CloudwatchAPIClient) ListMetrics(ctx context.Context, params *cloudwatch.ListMetricsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
 	start := 0
 	if params.NextToken != nil {
@@ -56,7 +102,10 @@ func (c *CloudwatchAPIClient) ListMetrics(ctx context.Context, params *cloudwatc
 	}
 	end := start + c.batchSize
 
-	metrics := c.getMetrics(params.Namespace, params.MetricName)
+	metrics := filterDimensions(c.getMetrics(params.Namespace, params.MetricName), params.Dimensions)
+	if params.RecentlyActive == types.RecentlyActivePt3h {
+		metrics = c.filterActive(metrics)
+	}
 	l := len(metrics)
 
 	if l < end {
@@ -70,18 +119,71 @@ func (c *CloudwatchAPIClient) ListMetrics(ctx context.Context, params *cloudwatc
 	}, nil
 }
 
+func (c *CloudwatchAPIClient) filterActive(metrics []types.Metric) []types.Metric {
+	filtered := []types.Metric{}
+	for _, m := range metrics {
+		if !c.inactive[metricKey(*m.Namespace, *m.MetricName)] {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func metricKey(namespace, metricName string) string {
+	return namespace + "/" + metricName
+}
+
 func (c *CloudwatchAPIClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
 	results := &cloudwatch.GetMetricDataOutput{
 		MetricDataResults: []types.MetricDataResult{},
 	}
-
+	ids := make(map[string]bool, len(params.MetricDataQueries))
 	for _, query := range params.MetricDataQueries {
+		ids[aws.StringValue(query.Id)] = true
+	}
+	for _, query := range params.MetricDataQueries {
+		if query.ReturnData != nil && !*query.ReturnData {
+			continue
+		}
+		if query.Expression != nil {
+			labels, ok := c.expressions[*query.Expression]
+			if !ok {
+				// Metric math over other queries of the request
+				for _, id := range queryIDRegexp.FindAllString(*query.Expression, -1) {
+					if !ids[id] {
+						return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "unknown query id " + id}
+					}
+				}
+				labels = []string{aws.StringValue(query.Label)}
+			}
+			for _, label := range labels {
+				timestamps, values := dataPoints(params.StartTime, params.EndTime, query.Period, params.ScanBy)
+				results.MetricDataResults = append(results.MetricDataResults, types.MetricDataResult{
+					Id:         query.Id,
+					Label:      aws.String(label),
+					Values:     values,
+					Timestamps: timestamps,
+				})
+			}
+			continue
+		}
 		qmetric := query.MetricStat.Metric
+		if err := c.errors[metricKey(*qmetric.Namespace, *qmetric.MetricName)]; err != nil {
+			return nil, err
+		}
+		if c.inactive[metricKey(*qmetric.Namespace, *qmetric.MetricName)] {
+			results.MetricDataResults = append(results.MetricDataResults, types.MetricDataResult{
+				Id: query.Id,
+			})
+			continue
+		}
 		for _, metric := range c.metrics[*qmetric.Namespace][*qmetric.MetricName] {
 			if reflect.DeepEqual(*qmetric, metric) {
+				timestamps, values := dataPoints(params.StartTime, params.EndTime, query.MetricStat.Period, params.ScanBy)
 				results.MetricDataResults = append(results.MetricDataResults, types.MetricDataResult{
-					Id:     query.Id,
-					Values: []float64{23.42},
+					Id:         query.Id,
+					Values:     values,
+					Timestamps: timestamps,
 				})
 				break
 			}
@@ -90,13 +192,37 @@ func (c *CloudwatchAPIClient) GetMetricData(ctx context.Context, params *cloudwa
 	return results, nil
 }
 
+// dataPoints returns one data point per period in the given range, or a
+// single data point if no range was given.
+func dataPoints(start, end *time.Time, period *int32, scanBy types.ScanBy) ([]time.Time, []float64) {
+	if start == nil || end == nil || period == nil {
+		return []time.Time{time.Now()}, []float64{23.42}
+	}
+	var (
+		p          = time.Duration(*period) * time.Second
+		timestamps = []time.Time{}
+		values     = []float64{}
+	)
+	for ts := end.Truncate(p); !ts.Before(*start); ts = ts.Add(-p) {
+		timestamps = append(timestamps, ts)
+		values = append(values, 23.42)
+	}
+	if scanBy == types.ScanByTimestampAscending {
+		for i, j := 0, len(timestamps)-1; i < j; i, j = i+1, j-1 {
+			timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+		}
+	}
+	return timestamps, values
+}
+
 func (c *CloudwatchAPIClient) Insert(namespace, metricName string, dims map[string]string) {
 	metric := types.Metric{
 		Namespace:  &namespace,
 		MetricName: &metricName,
 	}
 	for k, v := range dims {
-		metric.Dimensions = append(metric.Dimensions, types.Dimension{&k, &v})
+		name, value := k, v
+		metric.Dimensions = append(metric.Dimensions, types.Dimension{Name: &name, Value: &value})
 	}
 	if c.metrics[namespace] == nil {
 		c.metrics[namespace] = map[string][]types.Metric{}
@@ -109,3 +235,20 @@ func (c *CloudwatchAPIClient) InsertRandom(namespace, metricName string, count i
 		c.Insert(namespace, metricName, map[string]string{"foo": "bar-" + strconv.Itoa(count)})
 	}
 }
+
+// InsertInactive inserts count metrics without any data points.
+func (c *CloudwatchAPIClient) InsertInactive(namespace, metricName string, count int) {
+	c.inactive[metricKey(namespace, metricName)] = true
+	c.InsertRandom(namespace, metricName, count)
+}
+
+// Fail makes GetMetricData return err for queries including the metric.
+func (c *CloudwatchAPIClient) Fail(namespace, metricName string, err error) {
+	c.errors[metricKey(namespace, metricName)] = err
+}
+
+// InsertExpression makes GetMetricData return one time series per label for
+// the expression.
+func (c *CloudwatchAPIClient) InsertExpression(expression string, labels ...string) {
+	c.expressions[expression] = labels
+}
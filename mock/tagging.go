@@ -0,0 +1,110 @@
+package mock
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+)
+
+type TaggingAPIClient struct {
+	pageSize  int
+	resources []types.ResourceTagMapping
+	calls     int64
+}
+
+func NewTaggingAPIClient() *TaggingAPIClient {
+	return &TaggingAPIClient{pageSize: 100}
+}
+
+// InsertResource inserts a resource with the given ARN and tags.
+func (c *TaggingAPIClient) InsertResource(resourceARN string, tags map[string]string) {
+	r := types.ResourceTagMapping{ResourceARN: aws.String(resourceARN)}
+	for k, v := range tags {
+		r.Tags = append(r.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	c.resources = append(c.resources, r)
+}
+
+func (c *TaggingAPIClient) GetResources(ctx context.Context, params *resourcegroupstaggingapi.GetResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	atomic.AddInt64(&c.calls, 1)
+	resources := []types.ResourceTagMapping{}
+	for _, r := range c.resources {
+		if matchResourceType(*r.ResourceARN, params.ResourceTypeFilters) && matchTags(r.Tags, params.TagFilters) {
+			resources = append(resources, r)
+		}
+	}
+	start := 0
+	if token := aws.ToString(params.PaginationToken); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil {
+			return nil, err
+		}
+	}
+	end := start + c.pageSize
+	out := &resourcegroupstaggingapi.GetResourcesOutput{}
+	if end < len(resources) {
+		out.PaginationToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(resources)
+	}
+	out.ResourceTagMappingList = resources[start:end]
+	return out, nil
+}
+
+// Calls returns the number of GetResources calls.
+func (c *TaggingAPIClient) Calls() int {
+	return int(atomic.LoadInt64(&c.calls))
+}
+
+// matchResourceType returns whether the resource matches any of the filters
+// of the form service[:resourceType].
+func matchResourceType(resourceARN string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	a, err := arn.Parse(resourceARN)
+	if err != nil {
+		return false
+	}
+	for _, f := range filters {
+		parts := strings.SplitN(f, ":", 2)
+		if parts[0] != a.Service {
+			continue
+		}
+		if len(parts) == 1 || strings.HasPrefix(a.Resource, parts[1]+"/") || strings.HasPrefix(a.Resource, parts[1]+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTags returns whether the tags match all filters. A filter without
+// values matches any value.
+func matchTags(tags []types.Tag, filters []types.TagFilter) bool {
+	for _, f := range filters {
+		found := false
+		for _, t := range tags {
+			if *t.Key != *f.Key {
+				continue
+			}
+			if len(f.Values) == 0 {
+				found = true
+			}
+			for _, v := range f.Values {
+				if v == *t.Value {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var snapshotAgeDesc = prometheus.NewDesc(
+	"cloudwatch_exporter_job_snapshot_age_seconds",
+	"Age of the latest snapshot of a polled job.",
+	[]string{"job_name"}, nil,
+)
+
+// poller polls all jobs with a poll interval in the background and keeps the
+// latest result of each job in memory. This decouples the CloudWatch API
+// calls from the scrapes, which only return the latest snapshots.
+type poller struct {
+	sync.Mutex
+	logger       log.Logger
+	defaults     reporterConfig
+	newCollector func(context.Context, log.Logger, *reporterConfig) (*collector, error)
+	errorCounter prometheus.Counter
+
+	cancel    context.CancelFunc
+	snapshots map[string]*snapshot
+}
+
+// snapshot is the result of polling a job.
+type snapshot struct {
+	families []*dto.MetricFamily
+	time     time.Time
+}
+
+// Gather implements prometheus.Gatherer.
+func (s *snapshot) Gather() ([]*dto.MetricFamily, error) {
+	return s.families, nil
+}
+
+func newPoller(logger log.Logger, defaults reporterConfig, newCollector func(context.Context, log.Logger, *reporterConfig) (*collector, error), errorCounter prometheus.Counter) *poller {
+	return &poller{
+		logger:       logger,
+		defaults:     defaults,
+		newCollector: newCollector,
+		errorCounter: errorCounter,
+		cancel:       func() {},
+		snapshots:    make(map[string]*snapshot),
+	}
+}
+
+// update stops polling the current jobs and starts polling the jobs in c.
+// Snapshots of jobs no longer polled are dropped.
+func (p *poller) update(c *config) {
+	p.Lock()
+	defer p.Unlock()
+	p.cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	polled := make(map[string]bool)
+	for _, job := range c.Jobs {
+		if job.PollInterval == 0 {
+			continue
+		}
+		polled[job.Name] = true
+		go p.poll(ctx, job)
+	}
+	for name := range p.snapshots {
+		if !polled[name] {
+			delete(p.snapshots, name)
+		}
+	}
+}
+
+// poll polls the job every poll interval until ctx is canceled.
+func (p *poller) poll(ctx context.Context, job *jobConfig) {
+	ticker := time.NewTicker(time.Duration(job.PollInterval))
+	defer ticker.Stop()
+	for {
+		p.pollOnce(ctx, job)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *poller) pollOnce(ctx context.Context, job *jobConfig) {
+	logger := log.With(p.logger, "job", job.Name)
+	// Polls must not overlap.
+	pollCtx, cancel := context.WithTimeout(ctx, time.Duration(job.PollInterval))
+	defer cancel()
+	c, err := p.newCollector(pollCtx, logger, job.reporterConfig(p.defaults))
+	if err != nil {
+		p.errorCounter.Inc()
+		level.Error(logger).Log("msg", "Couldn't create reporter", "err", err.Error())
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		level.Error(logger).Log("msg", "Couldn't poll job, keeping previous snapshot", "err", err.Error())
+		return
+	}
+
+	labelJobMetrics(c, families, job.Name)
+
+	p.Lock()
+	defer p.Unlock()
+	// Don't store results of jobs that were removed while polling.
+	if ctx.Err() != nil {
+		return
+	}
+	// Partial results only replace a missing snapshot.
+	if _, ok := p.snapshots[job.Name]; ok && (pollCtx.Err() != nil || !scrapeSucceeded(families)) {
+		level.Error(logger).Log("msg", "Couldn't poll all metrics of job, keeping previous snapshot")
+		return
+	}
+	p.snapshots[job.Name] = &snapshot{families: families, time: time.Now()}
+}
+
+// scrapeSucceeded returns whether the families report a successful scrape.
+func scrapeSucceeded(families []*dto.MetricFamily) bool {
+	for _, mf := range families {
+		if mf.GetName() != "cloudwatch_exporter_scrape_success" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// labelJobMetrics adds the job_name label to the metrics not representing
+// data points, like aws_metrics_sent, so they don't collide across jobs.
+func labelJobMetrics(c *collector, families []*dto.MetricFamily, jobName string) {
+	data := make(map[string]bool)
+	c.descLock.Lock()
+	for _, family := range c.families {
+		data[family.GetName()] = true
+	}
+	c.descLock.Unlock()
+	for _, mf := range families {
+		if data[mf.GetName()] {
+			continue
+		}
+		for _, m := range mf.Metric {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String("job_name"), Value: proto.String(jobName)})
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *poller) Describe(ch chan<- *prometheus.Desc) {
+	ch <- snapshotAgeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (p *poller) Collect(ch chan<- prometheus.Metric) {
+	p.Lock()
+	defer p.Unlock()
+	for name, s := range p.snapshots {
+		ch <- prometheus.MustNewConstMetric(snapshotAgeDesc, prometheus.GaugeValue, time.Since(s.time).Seconds(), name)
+	}
+}
+
+// Gather implements prometheus.Gatherer. It returns the latest snapshots of
+// all polled jobs along with their age.
+func (p *poller) Gather() ([]*dto.MetricFamily, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(p)
+	gatherers := prometheus.Gatherers{registry}
+	p.Lock()
+	for _, s := range p.snapshots {
+		gatherers = append(gatherers, s)
+	}
+	p.Unlock()
+	return gatherers.Gather()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPoller(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	for i := 0; i < 23; i++ {
+		client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 42; i++ {
+		client.Insert("AWS/EBS", "VolumeWriteBytes", map[string]string{"VolumeId": "vol-" + strconv.Itoa(i)})
+	}
+
+	var (
+		logger       = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
+		errorCounter = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudwatch_errors_total",
+			Help: "Number of errors.",
+		})
+		emptyResultsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudwatch_metrics_without_datapoints_total",
+			Help: "Number of queried metrics without data points.",
+		}, []string{"metric_namespace"})
+	)
+	newJobCollector := func(ctx context.Context, logger log.Logger, config *reporterConfig) (*collector, error) {
+		collector := newTestCollector(t, client, config)
+		collector.ctx = ctx
+		collector.logger = logger
+		collector.errorCounter = errorCounter
+		collector.emptyResultsCounter = emptyResultsCounter
+		return collector, nil
+	}
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: ec2
+    namespace: AWS/EC2
+    poll_interval: 1h
+  - name: ebs
+    namespace: AWS/EBS
+    poll_interval: 1h
+  - name: elb
+    namespace: AWS/ELB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPoller(logger, newReporterConfig(), newJobCollector, errorCounter)
+	p.update(c)
+	for i := 0; ; i++ {
+		p.Lock()
+		l := len(p.snapshots)
+		p.Unlock()
+		if l == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected 2 snapshots but got %d", l)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, mf := range mfs {
+		counts[mf.GetName()] = len(mf.Metric)
+	}
+	for name, count := range map[string]int{
+		"aws_ec2_network_in_average":                   23,
+		"aws_ebs_volume_write_bytes_average":           42,
+		"aws_metrics_sent":                             2,
+		"cloudwatch_exporter_job_snapshot_age_seconds": 2,
+	} {
+		if counts[name] != count {
+			t.Fatalf("Expected %d %s metrics but got %d", count, name, counts[name])
+		}
+	}
+
+	c.Jobs = c.Jobs[1:]
+	p.update(c)
+	p.Lock()
+	_, ok := p.snapshots["ec2"]
+	p.Unlock()
+	if ok {
+		t.Fatal("Expected snapshot of removed job to be dropped")
+	}
+	p.update(&config{})
+}
+
+func TestPollerKeepsSnapshot(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	for i := 0; i < 10; i++ {
+		client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-" + strconv.Itoa(i)})
+	}
+	errorCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cloudwatch_errors_total",
+		Help: "Number of errors.",
+	})
+	newJobCollector := func(ctx context.Context, logger log.Logger, config *reporterConfig) (*collector, error) {
+		collector := newTestCollector(t, client, config)
+		collector.ctx = ctx
+		return collector, nil
+	}
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: ec2
+    namespace: AWS/EC2
+    poll_interval: 1h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPoller(log.NewNopLogger(), newReporterConfig(), newJobCollector, errorCounter)
+	job := c.job("ec2")
+
+	p.pollOnce(context.Background(), job)
+	s := p.snapshots["ec2"]
+	if s == nil {
+		t.Fatal("Expected snapshot")
+	}
+
+	client.Fail("AWS/EC2", "NetworkIn", &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"})
+	p.pollOnce(context.Background(), job)
+	if p.snapshots["ec2"] != s {
+		t.Fatal("Expected previous snapshot to be kept after failed poll")
+	}
+
+	// Without previous snapshot, partial results are stored.
+	delete(p.snapshots, "ec2")
+	p.pollOnce(context.Background(), job)
+	if p.snapshots["ec2"] == nil {
+		t.Fatal("Expected partial results to be stored without previous snapshot")
+	}
+}
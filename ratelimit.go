@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimits are the maximum number of calls per second of each API. Zero
+// disables the limit.
+type rateLimits struct {
+	listMetrics   float64
+	getMetricData float64
+	getResources  float64
+}
+
+// limiterKey identifies the scope of the AWS API limits.
+type limiterKey struct {
+	accountID string
+	region    string
+}
+
+// apiLimiters are the limiters for one account and region.
+type apiLimiters struct {
+	listMetrics   *rate.Limiter
+	getMetricData *rate.Limiter
+	getResources  *rate.Limiter
+}
+
+func newAPILimiters(limits rateLimits) *apiLimiters {
+	return &apiLimiters{
+		listMetrics:   newLimiter(limits.listMetrics),
+		getMetricData: newLimiter(limits.getMetricData),
+		getResources:  newLimiter(limits.getResources),
+	}
+}
+
+func newLimiter(limit float64) *rate.Limiter {
+	if limit <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(limit), int(math.Max(1, math.Ceil(limit))))
+}
+
+// concurrencyLimiter limits the number of concurrent batches across all
+// requests. A nil limiter doesn't limit.
+type concurrencyLimiter chan struct{}
+
+func newConcurrencyLimiter(n int) concurrencyLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(concurrencyLimiter, n)
+}
+
+// acquire waits for a free slot or until ctx is canceled.
+func (l concurrencyLimiter) acquire(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot acquired before.
+func (l concurrencyLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// limitedClient waits for the rate limiters before each API call.
+type limitedClient struct {
+	client interface {
+		cloudwatch.ListMetricsAPIClient
+		cloudwatch.GetMetricDataAPIClient
+	}
+	tagging  resourcegroupstaggingapi.GetResourcesAPIClient
+	limiters *apiLimiters
+	wait     *prometheus.HistogramVec
+}
+
+func (c *limitedClient) ListMetrics(ctx context.Context, params *cloudwatch.ListMetricsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
+	if err := c.waitFor(ctx, c.limiters.listMetrics, "ListMetrics"); err != nil {
+		return nil, err
+	}
+	return c.client.ListMetrics(ctx, params, optFns...)
+}
+
+func (c *limitedClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	if err := c.waitFor(ctx, c.limiters.getMetricData, "GetMetricData"); err != nil {
+		return nil, err
+	}
+	return c.client.GetMetricData(ctx, params, optFns...)
+}
+
+func (c *limitedClient) GetResources(ctx context.Context, params *resourcegroupstaggingapi.GetResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	if err := c.waitFor(ctx, c.limiters.getResources, "GetResources"); err != nil {
+		return nil, err
+	}
+	return c.tagging.GetResources(ctx, params, optFns...)
+}
+
+// waitFor waits until l allows the API call. If the wait would exceed the
+// deadline of ctx, context.DeadlineExceeded is returned right away.
+func (c *limitedClient) waitFor(ctx context.Context, l *rate.Limiter, apiCall string) error {
+	start := time.Now()
+	err := l.Wait(ctx)
+	c.wait.WithLabelValues(apiCall).Observe(time.Since(start).Seconds())
+	if err != nil && ctx.Err() == nil {
+		if _, ok := ctx.Deadline(); ok {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimitedClient(t *testing.T) {
+	var (
+		wait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "cloudwatch_exporter_rate_limiter_wait_seconds",
+			Help: "Time spent waiting for the rate limiter.",
+		}, []string{"api_call"})
+		c = &limitedClient{
+			client:   mock.NewCloudwatchAPIClient(),
+			limiters: newAPILimiters(rateLimits{getMetricData: 50}),
+			wait:     wait,
+		}
+		calls = 60
+		start = time.Now()
+	)
+	for i := 0; i < calls; i++ {
+		if _, err := c.GetMetricData(context.Background(), &cloudwatch.GetMetricDataInput{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first 50 calls use the burst, the other 10 need to wait 20ms each.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("Expected calls to be rate limited but took only %s", d)
+	}
+	if c := testutil.CollectAndCount(wait); c != 1 {
+		t.Fatalf("Expected wait times only for GetMetricData but got %d series", c)
+	}
+
+	// Unlimited APIs don't wait.
+	start = time.Now()
+	for i := 0; i < calls; i++ {
+		if _, err := c.ListMetrics(context.Background(), &cloudwatch.ListMetricsInput{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Expected unlimited calls but took %s", d)
+	}
+
+	// GetResources calls are limited separately.
+	c.tagging = mock.NewTaggingAPIClient()
+	if _, err := c.GetResources(context.Background(), &resourcegroupstaggingapi.GetResourcesInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := testutil.CollectAndCount(wait); c != 3 {
+		t.Fatalf("Expected wait times for GetResources but got %d series", c)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetMetricData(ctx, &cloudwatch.GetMetricDataInput{}); err == nil {
+		t.Fatal("Expected error waiting with canceled context")
+	}
+
+	// Waiting beyond the deadline fails right away.
+	c.limiters = newAPILimiters(rateLimits{getMetricData: 0.1})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.GetMetricData(ctx, &cloudwatch.GetMetricDataInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMetricData(ctx, &cloudwatch.GetMetricDataInput{}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(2)
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err == nil {
+		t.Fatal("Expected acquiring a third slot to time out")
+	}
+	l.release()
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nil limiter doesn't limit.
+	l = newConcurrencyLimiter(0)
+	for i := 0; i < 100; i++ {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -2,110 +2,293 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// maxDimensionFilters is the maximum number of dimension filters supported
+// by ListMetrics.
+const maxDimensionFilters = 10
+
+// regionRegexp matches AWS region names like eu-west-1 or us-gov-east-1.
+var regionRegexp = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
 type reporterConfig struct {
+	region      string
+	roleARN     string
+	externalID  string
+	sessionName string
+	endpoint    string
+	namespace   string
+	metricNames []string
+	dimensions  []types.DimensionFilter
+	// Only list metrics with data points in the last 3 hours
+	recentlyActive bool
+
+	// Client side filters
+	metricNameRegexp        *regexp.Regexp
+	metricNameExcludeRegexp *regexp.Regexp
+	dimensionRegexps        map[string]*regexp.Regexp
+
 	delayDuration time.Duration
 	rangeDuration time.Duration
 	period        int32
-	stat          string
+	stats         []string
+	timestamps    bool
+	backfill      bool
+	// Metrics Insights query, used instead of listing metrics
+	insightsQuery      string
+	insightsMetricName string
+	// Search term and the dimensions of its schema, used instead of listing
+	// metrics
+	search           string
+	searchDimensions []string
+	// Metric math expressions over the listed metrics
+	expressions []expression
+	// Fail the whole scrape if any batch fails
+	strict bool
+	// Tag keys added as labels or, with tagInfo, as aws_resource_info metric
+	tagKeys []string
+	tagInfo bool
+	// Only return metrics of resources with these tags
+	tagFilters []tagFilter
+	// Number of queries per GetMetricData call and concurrent calls per
+	// request
+	batchSize   int
+	concurrency int
+}
+
+func newReporterConfig() reporterConfig {
+	return reporterConfig{
+		delayDuration: 600 * time.Second,
+		rangeDuration: 600 * time.Second,
+		period:        60,
+		batchSize:     maxBatchSize,
+		concurrency:   10,
+	}
+}
+
+// validateBatchSize checks that a batch fits the queries of all statistics
+// of a metric.
+func (c *reporterConfig) validateBatchSize() error {
+	if len(c.stats) > c.batchSize {
+		return fmt.Errorf("too many statistics, got %d but at most %d are supported", len(c.stats), c.batchSize)
+	}
+	return nil
+}
+
+// metricNamesLabel returns the metric names joined for use as label value.
+func (c *reporterConfig) metricNamesLabel() string {
+	return strings.Join(c.metricNames, ",")
 }
 
 type reporter struct {
-	config     *reporterConfig
-	namespace  string // FIXME: move to config?
-	metricName string
+	config    *reporterConfig
+	region    string
+	accountID string
 	cloudwatch.ListMetricsAPIClient
 	cloudwatch.GetMetricDataAPIClient
 	logger          log.Logger
 	durationSummary *prometheus.SummaryVec
+	cache           *listCache // optional
+	tags            *tagClient // optional
 }
 
-func newReporter(logger log.Logger, rconfig *reporterConfig, durationSummary *prometheus.SummaryVec) (*reporter, error) {
-	cwc, err := config.LoadDefaultConfig(context.TODO())
+// newReporter returns a reporter for the config using a client of the pool.
+// If the account ID of the client can't be determined, the account_id label
+// is omitted.
+func newReporter(ctx context.Context, logger log.Logger, rconfig *reporterConfig, durationSummary *prometheus.SummaryVec, clients *clientPool, cache *listCache) (*reporter, error) {
+	if rconfig.roleARN != "" {
+		if _, err := roleAccountID(rconfig.roleARN); err != nil {
+			return nil, err
+		}
+	}
+	client, err := clients.get(rconfig)
 	if err != nil {
 		return nil, err
 	}
-
-	client := cloudwatch.NewFromConfig(cwc)
+	accountID, err := client.account(ctx)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Couldn't determine account ID", "err", err)
+	}
 	return &reporter{
 		config:                 rconfig,
+		region:                 client.region,
+		accountID:              accountID,
 		ListMetricsAPIClient:   client,
 		GetMetricDataAPIClient: client,
 		logger:                 logger,
 		durationSummary:        durationSummary,
+		cache:                  cache,
+		tags:                   client.tags,
 	}, nil
 }
 
-func (c *reporter) ListMetrics() ([]types.Metric, error) {
-	input := &cloudwatch.ListMetricsInput{}
-	if c.metricName != "*" {
-		input.MetricName = &c.metricName
+// ListMetrics returns the metrics for all configured metric names. The metric
+// name "*" matches all metrics in the namespace. With tag filters, only
+// metrics of matching resources are returned.
+func (c *reporter) ListMetrics(ctx context.Context) ([]types.Metric, error) {
+	metrics := []types.Metric{}
+	for _, metricName := range c.config.metricNames {
+		ms, err := c.listMetrics(ctx, metricName)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, ms...)
+	}
+	if len(c.config.tagFilters) > 0 {
+		return c.filterTagged(ctx, metrics)
+	}
+	return metrics, nil
+}
+
+// listMetrics returns the metrics for metricName, from the cache if one is
+// set.
+func (c *reporter) listMetrics(ctx context.Context, metricName string) ([]types.Metric, error) {
+	if c.cache == nil {
+		return c.listMetricsUncached(ctx, metricName)
+	}
+	return c.cache.get(ctx, newListCacheKey(c, metricName), func(ctx context.Context) ([]types.Metric, error) {
+		return c.listMetricsUncached(ctx, metricName)
+	})
+}
+
+func (c *reporter) listMetricsUncached(ctx context.Context, metricName string) ([]types.Metric, error) {
+	input := &cloudwatch.ListMetricsInput{
+		Dimensions: c.config.dimensions,
 	}
-	if c.namespace != "*" {
-		input.Namespace = &c.namespace
+	if c.config.recentlyActive {
+		input.RecentlyActive = types.RecentlyActivePt3h
+	}
+	if metricName != "*" {
+		input.MetricName = &metricName
+	}
+	if c.config.namespace != "*" {
+		input.Namespace = &c.config.namespace
 	}
 
 	p := cloudwatch.NewListMetricsPaginator(c.ListMetricsAPIClient, input)
 	metrics := []types.Metric{}
 	for p.HasMorePages() {
 		start := time.Now()
-		results, err := p.NextPage(context.TODO())
+		results, err := p.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
-		c.durationSummary.WithLabelValues(c.namespace, c.metricName, "ListMetrics").Observe(time.Since(start).Seconds())
+		c.durationSummary.WithLabelValues(c.config.namespace, metricName, "ListMetrics").Observe(time.Since(start).Seconds())
 		metrics = append(metrics, results.Metrics...)
 	}
 
 	return metrics, nil
 }
 
-func (c *reporter) GetMetricsResults(metrics []types.Metric) ([]types.MetricDataResult, error) {
+// GetMetricsResults queries the metrics with all statistics of the config.
+// The expressions are sent along in the same request.
+func (c *reporter) GetMetricsResults(ctx context.Context, metrics []types.Metric, expressions ...types.MetricDataQuery) ([]types.MetricDataResult, error) {
 	var (
-		now               = time.Now()
-		startDate         = now.Add(-(c.config.delayDuration + c.config.rangeDuration))
-		endDate           = now.Add(-c.config.delayDuration)
-		results           = []types.MetricDataResult{}
-		metricDataQueries = make([]types.MetricDataQuery, len(metrics))
+		ns                = len(c.config.stats)
+		metricDataQueries = make([]types.MetricDataQuery, len(metrics)*ns, len(metrics)*ns+len(expressions))
 	)
 
+	// We query each metric once per statistic. The query index encoded in
+	// the Id allows to map results back to metric and statistic.
 	for i := range metrics {
-		metricDataQueries[i] = types.MetricDataQuery{
-			Id: aws.String("n" + strconv.Itoa(i)),
-			MetricStat: &types.MetricStat{
-				Metric: &metrics[i],
-				Period: &c.config.period,
-				Stat:   &c.config.stat,
-			},
+		for j := range c.config.stats {
+			q := i*ns + j
+			metricDataQueries[q] = types.MetricDataQuery{
+				Id: aws.String("n" + strconv.Itoa(q)),
+				MetricStat: &types.MetricStat{
+					Metric: &metrics[i],
+					Period: &c.config.period,
+					Stat:   &c.config.stats[j],
+				},
+				ReturnData: aws.Bool(true),
+			}
+		}
+	}
+	return c.getMetricData(ctx, append(metricDataQueries, expressions...))
+}
+
+// GetInsightsResults runs the Metrics Insights query of the config. The time
+// series are labeled with the values of the GROUP BY keys.
+func (c *reporter) GetInsightsResults(ctx context.Context) ([]types.MetricDataResult, error) {
+	query := types.MetricDataQuery{
+		Id:         aws.String("q0"),
+		Expression: &c.config.insightsQuery,
+		Period:     &c.config.period,
+	}
+	if keys := parseGroupBy(c.config.insightsQuery); len(keys) > 0 {
+		query.Label = aws.String(insightsLabel(keys))
+	}
+	return c.getMetricData(ctx, []types.MetricDataQuery{query})
+}
+
+// GetSearchResults runs the search expression of the config once per
+// statistic. The index of the statistic is encoded in the Id.
+func (c *reporter) GetSearchResults(ctx context.Context) ([]types.MetricDataResult, error) {
+	var (
+		label   = searchLabel(c.config.searchDimensions)
+		queries = make([]types.MetricDataQuery, len(c.config.stats))
+	)
+	for j, stat := range c.config.stats {
+		queries[j] = types.MetricDataQuery{
+			Id:         aws.String("s" + strconv.Itoa(j)),
+			Expression: aws.String(c.config.searchExpression(stat)),
+			Label:      aws.String(label),
 		}
 	}
+	return c.getMetricData(ctx, queries)
+}
 
-	p := cloudwatch.NewGetMetricDataPaginator(
-		c.GetMetricDataAPIClient,
-		&cloudwatch.GetMetricDataInput{
-			StartTime:         &startDate,
-			EndTime:           &endDate,
-			MetricDataQueries: metricDataQueries,
-		})
+func (c *reporter) getMetricData(ctx context.Context, metricDataQueries []types.MetricDataQuery) ([]types.MetricDataResult, error) {
+	var (
+		now       = time.Now()
+		startDate = now.Add(-(c.config.delayDuration + c.config.rangeDuration))
+		endDate   = now.Add(-c.config.delayDuration)
+		results   = []types.MetricDataResult{}
+	)
+	input := &cloudwatch.GetMetricDataInput{
+		StartTime:         &startDate,
+		EndTime:           &endDate,
+		MetricDataQueries: metricDataQueries,
+	}
+	if c.config.backfill {
+		input.ScanBy = types.ScanByTimestampAscending
+	}
+	p := cloudwatch.NewGetMetricDataPaginator(c.GetMetricDataAPIClient, input)
 
+	// Data points of a query might be split across pages, so we merge
+	// results with the same Id. Queries returning multiple time series, like
+	// grouped Metrics Insights queries, return them with the same Id but
+	// different labels.
+	index := make(map[string]int)
 	for p.HasMorePages() {
 		start := time.Now()
-		r, err := p.NextPage(context.TODO())
+		r, err := p.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
-		c.durationSummary.WithLabelValues(c.namespace, c.metricName, "GetMetricsResults").Observe(time.Since(start).Seconds())
-		results = append(results, r.MetricDataResults...)
+		c.durationSummary.WithLabelValues(c.config.namespace, c.config.metricNamesLabel(), "GetMetricsResults").Observe(time.Since(start).Seconds())
+		for _, result := range r.MetricDataResults {
+			key := aws.ToString(result.Id) + "\xff" + aws.ToString(result.Label)
+			if i, ok := index[key]; ok {
+				results[i].Values = append(results[i].Values, result.Values...)
+				results[i].Timestamps = append(results[i].Timestamps, result.Timestamps...)
+				continue
+			}
+			index[key] = len(results)
+			results = append(results, result)
+		}
 	}
 	return results, nil
 }
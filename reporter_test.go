@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/discordianfish/cloudwatch-exporter/mock"
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,29 +20,45 @@ func TestReporter(t *testing.T) {
 		client.InsertRandom("AWS/EC2", mn, count)
 	}
 	client.InsertRandom("AWS/EBS", "VolumeWriteBytes", count)
+	client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-web", "AutoScalingGroupName": "web"})
+	client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-db"})
 
 	for _, tc := range []struct {
-		namespace  string
-		metricName string
-		count      int
+		namespace   string
+		metricNames []string
+		dimensions  []string
+		count       int
 	}{
-		{"AWS/EC2", "NetworkIn", count},
-		{"AWS/EC2", "*", count * len(metricNames)},
-		{"AWS/EBS", "VolumeWriteBytes", count},
-		{"AWS/EBS", "*", count},
-		{"*", "*", count * (len(metricNames) + 1)}, // Also returns the EBS metric
+		// +2 to account for the metrics with InstanceId dimension
+		{"AWS/EC2", []string{"NetworkIn"}, nil, count + 2},
+		{"AWS/EC2", []string{"NetworkIn", "NetworkOut"}, nil, count*2 + 2},
+		{"AWS/EC2", []string{"*"}, nil, count*len(metricNames) + 2},
+		{"AWS/EBS", []string{"VolumeWriteBytes"}, nil, count},
+		{"AWS/EBS", []string{"*"}, nil, count},
+		{"*", []string{"*"}, nil, count*(len(metricNames)+1) + 2}, // Also returns the EBS metric
+		{"AWS/EC2", []string{"NetworkIn"}, []string{"InstanceId=i-web"}, 1},
+		{"AWS/EC2", []string{"NetworkIn"}, []string{"InstanceId"}, 2},
+		{"AWS/EC2", []string{"NetworkIn"}, []string{"InstanceId", "AutoScalingGroupName=web"}, 1},
+		{"AWS/EC2", []string{"NetworkIn"}, []string{"InstanceId=i-unknown"}, 0},
 	} {
+		dimensions, err := parseDimensions(tc.dimensions)
+		if err != nil {
+			t.Fatal(err)
+		}
 		reporter := &reporter{
 			ListMetricsAPIClient:   client,
 			GetMetricDataAPIClient: client,
-			namespace:              tc.namespace,
-			metricName:             tc.metricName,
+			config: &reporterConfig{
+				namespace:   tc.namespace,
+				metricNames: tc.metricNames,
+				dimensions:  dimensions,
+			},
 			durationSummary: prometheus.NewSummaryVec(prometheus.SummaryOpts{
 				Name: "cloudwatch_request_duration_seconds",
 				Help: "Duration of cloudwatch metric collection.",
 			}, []string{"metric_namespace", "metric_name", "api_call"}),
 		}
-		metrics, err := reporter.ListMetrics()
+		metrics, err := reporter.ListMetrics(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -49,3 +67,65 @@ func TestReporter(t *testing.T) {
 		}
 	}
 }
+
+func TestReporterTagFilters(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-web"})
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-db"})
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-staging"})
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"AutoScalingGroupName": "web"})
+	client.Insert("AWS/EBS", "VolumeWriteBytes", map[string]string{"VolumeId": "vol-web"})
+	client.Insert("Custom/App", "Requests", map[string]string{"InstanceId": "i-web"})
+	tagging := mock.NewTaggingAPIClient()
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-web", map[string]string{"Environment": "production", "Team": "web"})
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-db", map[string]string{"Environment": "production", "Team": "db"})
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-staging", map[string]string{"Environment": "staging", "Team": "web"})
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:volume/vol-web", map[string]string{"Environment": "production", "Team": "web"})
+
+	for _, tc := range []struct {
+		namespace string
+		tags      []string
+		count     int
+		err       bool
+	}{
+		{namespace: "AWS/EC2", tags: []string{"Environment=production"}, count: 2},
+		{namespace: "AWS/EC2", tags: []string{"Environment=production", "Team=web"}, count: 1},
+		{namespace: "AWS/EC2", tags: []string{"Environment=production", "Environment=staging"}, count: 3},
+		{namespace: "AWS/EC2", tags: []string{"Team"}, count: 3},
+		{namespace: "AWS/EC2", tags: []string{"Environment=development"}, count: 0},
+		{namespace: "*", tags: []string{"Team=web"}, count: 3},
+		{namespace: "Custom/App", tags: []string{"Team=web"}, err: true},
+	} {
+		filters, err := parseTagFilters(tc.tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reporter := &reporter{
+			ListMetricsAPIClient:   client,
+			GetMetricDataAPIClient: client,
+			config: &reporterConfig{
+				namespace:   tc.namespace,
+				metricNames: []string{"*"},
+				tagFilters:  filters,
+			},
+			tags: newTagClient(tagging, time.Minute),
+			durationSummary: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+				Name: "cloudwatch_request_duration_seconds",
+				Help: "Duration of cloudwatch metric collection.",
+			}, []string{"metric_namespace", "metric_name", "api_call"}),
+		}
+		metrics, err := reporter.ListMetrics(context.Background())
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%s %v: expected error", tc.namespace, tc.tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := len(metrics); l != tc.count {
+			t.Fatalf("%s %v: expected %d metrics but got %d", tc.namespace, tc.tags, tc.count, l)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retryableCodes are the AWS error codes worth retrying.
+var retryableCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"TooManyRequestsException":               true,
+	"RequestLimitExceeded":                   true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"ProvisionedThroughputExceededException": true,
+	"InternalFailure":                        true,
+	"InternalServiceFault":                   true,
+	"ServiceUnavailable":                     true,
+	"RequestTimeout":                         true,
+	"RequestTimeoutException":                true,
+}
+
+// retryPolicy describes how often and how long to wait between retries.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	// Fraction of the delay that is randomized, between 0 and 1
+	jitter float64
+}
+
+// delay returns the time to wait before the given retry, starting with 1.
+// The delay doubles with every retry up to maxDelay.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < retry && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d - time.Duration(p.jitter*rand.Float64()*float64(d))
+}
+
+// retryable returns whether the request failing with err should be retried.
+func retryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code == 429 || code >= 500
+	}
+	return false
+}
+
+// retryingClient retries failed CloudWatch and Resource Groups Tagging API
+// calls according to the retry policy. The client it wraps should not retry
+// on its own.
+type retryingClient struct {
+	client interface {
+		cloudwatch.ListMetricsAPIClient
+		cloudwatch.GetMetricDataAPIClient
+		resourcegroupstaggingapi.GetResourcesAPIClient
+	}
+	policy  retryPolicy
+	retries *prometheus.CounterVec
+}
+
+func (c *retryingClient) ListMetrics(ctx context.Context, params *cloudwatch.ListMetricsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
+	var out *cloudwatch.ListMetricsOutput
+	err := c.retry(ctx, "ListMetrics", func() (err error) {
+		out, err = c.client.ListMetrics(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryingClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	var out *cloudwatch.GetMetricDataOutput
+	err := c.retry(ctx, "GetMetricData", func() (err error) {
+		out, err = c.client.GetMetricData(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryingClient) GetResources(ctx context.Context, params *resourcegroupstaggingapi.GetResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	var out *resourcegroupstaggingapi.GetResourcesOutput
+	err := c.retry(ctx, "GetResources", func() (err error) {
+		out, err = c.client.GetResources(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryingClient) retry(ctx context.Context, apiCall string, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= c.policy.maxAttempts || !retryable(err) {
+			return err
+		}
+		c.retries.WithLabelValues(apiCall, errorReason(err)).Inc()
+		t := time.NewTimer(c.policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingClient fails the first calls with the given errors.
+type failingClient struct {
+	cloudwatch.ListMetricsAPIClient
+	resourcegroupstaggingapi.GetResourcesAPIClient
+	errs  []error
+	calls int
+}
+
+func (c *failingClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return nil, c.errs[c.calls-1]
+	}
+	return &cloudwatch.GetMetricDataOutput{}, nil
+}
+
+func TestRetryingClient(t *testing.T) {
+	var (
+		throttling  = &smithy.GenericAPIError{Code: "Throttling"}
+		invalid     = &smithy.GenericAPIError{Code: "InvalidParameterValue"}
+		unavailable = &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			Err:      errors.New("service unavailable"),
+		}
+	)
+	for _, tc := range []struct {
+		errs    []error
+		calls   int
+		err     bool
+		retries float64
+	}{
+		{nil, 1, false, 0},
+		{[]error{throttling, throttling}, 3, false, 2},
+		{[]error{throttling, throttling, throttling}, 3, true, 2},
+		{[]error{invalid}, 1, true, 0},
+		{[]error{unavailable}, 2, false, 1},
+	} {
+		var (
+			fc      = &failingClient{errs: tc.errs}
+			retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "cloudwatch_exporter_api_retries_total",
+				Help: "Number of retried API calls.",
+			}, []string{"api_call", "code"})
+			c = &retryingClient{
+				client:  fc,
+				policy:  retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond, jitter: 0.5},
+				retries: retries,
+			}
+		)
+		_, err := c.GetMetricData(context.Background(), &cloudwatch.GetMetricDataInput{})
+		if (err != nil) != tc.err {
+			t.Fatalf("%v: expected error %t but got %v", tc.errs, tc.err, err)
+		}
+		if fc.calls != tc.calls {
+			t.Fatalf("%v: expected %d calls but got %d", tc.errs, tc.calls, fc.calls)
+		}
+		var r float64
+		for _, code := range []string{"Throttling", "unknown"} {
+			r += testutil.ToFloat64(retries.WithLabelValues("GetMetricData", code))
+		}
+		if r != tc.retries {
+			t.Fatalf("%v: expected %v retries but got %v", tc.errs, tc.retries, r)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second, jitter: 0.5}
+	for _, tc := range []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := p.delay(tc.retry); d > tc.max || d < tc.max/2 {
+				t.Fatalf("retry %d: expected delay between %s and %s but got %s", tc.retry, tc.max/2, tc.max, d)
+			}
+		}
+	}
+}
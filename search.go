@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// searchSchemaRegexp matches the schema of a search term, like
+// {AWS/EC2,InstanceId}.
+var searchSchemaRegexp = regexp.MustCompile(`^\s*\{([^}]*)\}`)
+
+// parseSearchSchema returns the namespace and dimension names of the schema
+// the search term starts with.
+func parseSearchSchema(search string) (string, []string, error) {
+	m := searchSchemaRegexp.FindStringSubmatch(search)
+	if m == nil {
+		return "", nil, fmt.Errorf("search must start with a schema like {AWS/EC2,InstanceId}")
+	}
+	keys := strings.Split(m[1], ",")
+	for i, key := range keys {
+		keys[i] = strings.Trim(strings.TrimSpace(key), `"`)
+		if keys[i] == "" {
+			return "", nil, fmt.Errorf("invalid search schema %q", m[0])
+		}
+	}
+	return keys[0], keys[1:], nil
+}
+
+// searchLabel returns the label template making CloudWatch label each time
+// series with its metric name and the values of the dimensions.
+func searchLabel(dimensions []string) string {
+	props := make([]string, len(dimensions)+1)
+	props[0] = "MetricName"
+	for i, d := range dimensions {
+		props[i+1] = "Dim." + d
+	}
+	return dynamicLabel(props)
+}
+
+// searchMetric returns the metric of a time series labeled by searchLabel. It
+// returns false if the label doesn't match the dimensions.
+func searchMetric(namespace string, dimensions []string, label string) (types.Metric, bool) {
+	parts, ok := splitLabel(label, len(dimensions)+1)
+	if !ok {
+		return types.Metric{}, false
+	}
+	m := types.Metric{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String(parts[0]),
+		Dimensions: make([]types.Dimension, len(dimensions)),
+	}
+	for i, d := range dimensions {
+		m.Dimensions[i] = types.Dimension{Name: aws.String(d), Value: aws.String(parts[i+1])}
+	}
+	return m, true
+}
+
+// searchExpression returns the SEARCH expression for the given statistic.
+func (c *reporterConfig) searchExpression(stat string) string {
+	return fmt.Sprintf("SEARCH('%s', '%s', %d)", c.search, stat, c.period)
+}
+
+// collectSearch collects the metrics found by the search expression of the
+// config.
+func (c *collector) collectSearch(ch chan<- prometheus.Metric) {
+	results, err := c.reporter.GetSearchResults(c.ctx)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			atomic.StoreUint32(&c.deadlineExceeded, 1)
+			return
+		}
+		level.Error(c.logger).Log("msg", "failed to get search results", "err", err)
+		c.batchFailed(ch, errorReason(err), err)
+		return
+	}
+	for _, result := range results {
+		// j is the index of the statistic
+		j, err := strconv.Atoi((*result.Id)[1:]) // strip "s" prefix
+		if err != nil {
+			panic(err)
+		}
+		stat := c.config.stats[j]
+		m, ok := searchMetric(c.config.namespace, c.config.searchDimensions, aws.ToString(result.Label))
+		if !ok {
+			level.Warn(c.logger).Log("msg", "Skipping search result with unexpected label", "label", aws.ToString(result.Label))
+			continue
+		}
+		if len(result.Values) == 0 {
+			c.emptyResultsCounter.WithLabelValues(c.config.namespace).Inc()
+			continue
+		}
+		if c.config.backfill {
+			for i, value := range result.Values {
+				c.collectMetric(ch, &m, stat, value, result.Timestamps[i])
+			}
+			continue
+		}
+		var ts time.Time
+		if len(result.Timestamps) > 0 {
+			ts = result.Timestamps[0]
+		}
+		c.collectMetric(ch, &m, stat, result.Values[0], ts)
+	}
+}
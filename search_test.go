@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseSearchSchema(t *testing.T) {
+	for _, tc := range []struct {
+		search     string
+		namespace  string
+		dimensions []string
+		err        bool
+	}{
+		{search: `{AWS/EC2,InstanceId} MetricName="CPUUtilization"`, namespace: "AWS/EC2", dimensions: []string{"InstanceId"}},
+		{search: `{"AWS/ApplicationELB", LoadBalancer, "AvailabilityZone"}`, namespace: "AWS/ApplicationELB", dimensions: []string{"LoadBalancer", "AvailabilityZone"}},
+		{search: `{AWS/Usage} ResourceCount`, namespace: "AWS/Usage", dimensions: []string{}},
+		{search: `MetricName="CPUUtilization"`, err: true},
+		{search: `{AWS/EC2,} CPUUtilization`, err: true},
+	} {
+		namespace, dimensions, err := parseSearchSchema(tc.search)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", tc.search)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.search, err)
+		}
+		if namespace != tc.namespace || !reflect.DeepEqual(dimensions, tc.dimensions) {
+			t.Fatalf("%q: expected %s %v but got %s %v", tc.search, tc.namespace, tc.dimensions, namespace, dimensions)
+		}
+	}
+}
+
+func TestSearchMetric(t *testing.T) {
+	dimensions := []string{"LoadBalancer", "TargetGroup"}
+	if label := searchLabel(dimensions); label != "${PROP('MetricName')}\x1f${PROP('Dim.LoadBalancer')}\x1f${PROP('Dim.TargetGroup')}" {
+		t.Fatalf("Unexpected label template %q", label)
+	}
+	for _, tc := range []struct {
+		label string
+		name  string
+		dims  []string
+		ok    bool
+	}{
+		{"RequestCount\x1fapp/web 1\x1ftargetgroup/web", "RequestCount", []string{"app/web 1", "targetgroup/web"}, true},
+		{"RequestCount app/web targetgroup/web", "", nil, false},
+		{"RequestCount\x1fapp/web", "", nil, false},
+	} {
+		m, ok := searchMetric("AWS/ApplicationELB", dimensions, tc.label)
+		if ok != tc.ok {
+			t.Fatalf("%q: expected %t but got %t", tc.label, tc.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if name := aws.ToString(m.MetricName); name != tc.name {
+			t.Fatalf("%q: expected metric name %q but got %q", tc.label, tc.name, name)
+		}
+		for i, d := range m.Dimensions {
+			if aws.ToString(d.Value) != tc.dims[i] {
+				t.Fatalf("%q: expected %s %q but got %q", tc.label, dimensions[i], tc.dims[i], aws.ToString(d.Value))
+			}
+		}
+	}
+}
+
+func TestCollectorSearch(t *testing.T) {
+	search := `{AWS/EC2,InstanceId} MetricName="CPUUtilization"`
+	client := mock.NewCloudwatchAPIClient()
+	labels := []string{
+		"CPUUtilization" + labelSeparator + "i-a",
+		"CPUUtilization" + labelSeparator + "i-b",
+		"CPUUtilization i-c", // not matching the dimensions
+	}
+	client.InsertExpression(`SEARCH('`+search+`', 'Average', 60)`, labels...)
+	client.InsertExpression(`SEARCH('`+search+`', 'Maximum', 60)`, labels...)
+
+	c, err := parseConfig([]byte(`
+jobs:
+  - name: ec2
+    search: '` + search + `'
+    stats: [Average, Maximum]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.job("ec2").reporterConfig(newReporterConfig())
+	if config.namespace != "AWS/EC2" {
+		t.Fatalf("Expected namespace of search but got %q", config.namespace)
+	}
+	collector := newTestCollector(t, client, config)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, mf := range mfs {
+		counts[mf.GetName()] = len(mf.Metric)
+		if mf.GetName() != "aws_ec2_cpu_utilization_average" {
+			continue
+		}
+		if id := labelValue(mf.Metric[0], "instance_id"); id != "i-a" {
+			t.Fatalf("Expected instance_id i-a but got %q", id)
+		}
+	}
+	for _, name := range []string{"aws_ec2_cpu_utilization_average", "aws_ec2_cpu_utilization_maximum"} {
+		if counts[name] != 2 {
+			t.Fatalf("Expected 2 series of %s but got %d (%v)", name, counts[name], counts)
+		}
+	}
+}
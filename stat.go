@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	standardStats = []string{"SampleCount", "Average", "Sum", "Minimum", "Maximum"}
+
+	// Extended statistics like p99, tm99 or p99.9
+	shortStatRegexp = regexp.MustCompile(`^(?i)(p|tm|wm|tc|ts)(\d+(?:\.\d+)?)$`)
+	// Extended statistics with ranges like TM(10%:90%), TM(:150) or PR(100:2000)
+	rangeStatRegexp = regexp.MustCompile(`^(?i)(tm|wm|tc|ts|pr)\(([^:()]*):([^:()]*)\)$`)
+	// Bound of a range statistic, either absolute or percent
+	statBoundRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)(%?)$`)
+)
+
+// parseStats returns the deduplicated and validated statistics from the
+// given stat query parameter values. Each value may be a comma separated
+// list of statistics.
+func parseStats(values []string) ([]string, error) {
+	var (
+		stats = []string{}
+		seen  = make(map[string]bool)
+	)
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			stat, err := parseStat(s)
+			if err != nil {
+				return nil, err
+			}
+			if seen[stat] {
+				continue
+			}
+			seen[stat] = true
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
+
+// parseStat validates the given statistic and returns it in the canonical
+// form expected by CloudWatch.
+func parseStat(stat string) (string, error) {
+	for _, s := range standardStats {
+		if strings.EqualFold(stat, s) {
+			return s, nil
+		}
+	}
+	if strings.EqualFold(stat, "IQR") {
+		return "IQR", nil
+	}
+	if m := shortStatRegexp.FindStringSubmatch(stat); m != nil {
+		if err := checkPercent(m[2]); err != nil {
+			return "", fmt.Errorf("invalid statistic %q: %s", stat, err)
+		}
+		return strings.ToLower(m[1]) + m[2], nil
+	}
+	if m := rangeStatRegexp.FindStringSubmatch(stat); m != nil {
+		var (
+			fn           = strings.ToUpper(m[1])
+			lower, upper = m[2], m[3]
+		)
+		if lower == "" && upper == "" {
+			return "", fmt.Errorf("invalid statistic %q: at least one bound required", stat)
+		}
+		for _, bound := range []string{lower, upper} {
+			if bound == "" {
+				continue
+			}
+			bm := statBoundRegexp.FindStringSubmatch(bound)
+			if bm == nil {
+				return "", fmt.Errorf("invalid statistic %q: invalid bound %q", stat, bound)
+			}
+			if bm[2] == "" {
+				continue
+			}
+			if fn == "PR" {
+				return "", fmt.Errorf("invalid statistic %q: PR requires absolute bounds", stat)
+			}
+			if err := checkPercent(bm[1]); err != nil {
+				return "", fmt.Errorf("invalid statistic %q: %s", stat, err)
+			}
+		}
+		return fmt.Sprintf("%s(%s:%s)", fn, lower, upper), nil
+	}
+	return "", fmt.Errorf("invalid statistic %q", stat)
+}
+
+func checkPercent(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	if f > 100 {
+		return fmt.Errorf("percent %s out of range", s)
+	}
+	return nil
+}
+
+// statSuffix returns the metric name suffix for the given canonical
+// statistic, e.g. p99_9 for p99.9 and tm_10pct_90pct for TM(10%:90%).
+func statSuffix(stat string) string {
+	if m := rangeStatRegexp.FindStringSubmatch(stat); m != nil {
+		return strings.ToLower(m[1]) + "_" + statBoundSuffix(m[2], "min") + "_" + statBoundSuffix(m[3], "max")
+	}
+	return strings.Replace(strings.ToLower(stat), ".", "_", -1)
+}
+
+func statBoundSuffix(bound, empty string) string {
+	if bound == "" {
+		return empty
+	}
+	bound = strings.Replace(bound, ".", "_", -1)
+	return strings.Replace(bound, "%", "pct", -1)
+}
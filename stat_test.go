@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseStat(t *testing.T) {
+	for _, tc := range []struct {
+		stat   string
+		parsed string
+		suffix string
+		err    bool
+	}{
+		{stat: "Average", parsed: "Average", suffix: "average"},
+		{stat: "samplecount", parsed: "SampleCount", suffix: "samplecount"},
+		{stat: "p99", parsed: "p99", suffix: "p99"},
+		{stat: "P99.9", parsed: "p99.9", suffix: "p99_9"},
+		{stat: "p100", parsed: "p100", suffix: "p100"},
+		{stat: "tm99", parsed: "tm99", suffix: "tm99"},
+		{stat: "WM90", parsed: "wm90", suffix: "wm90"},
+		{stat: "tc50", parsed: "tc50", suffix: "tc50"},
+		{stat: "ts75.5", parsed: "ts75.5", suffix: "ts75_5"},
+		{stat: "iqr", parsed: "IQR", suffix: "iqr"},
+		{stat: "TM(10%:90%)", parsed: "TM(10%:90%)", suffix: "tm_10pct_90pct"},
+		{stat: "tm(:99.5%)", parsed: "TM(:99.5%)", suffix: "tm_min_99_5pct"},
+		{stat: "TS(80%:)", parsed: "TS(80%:)", suffix: "ts_80pct_max"},
+		{stat: "WM(150:1000)", parsed: "WM(150:1000)", suffix: "wm_150_1000"},
+		{stat: "PR(:300)", parsed: "PR(:300)", suffix: "pr_min_300"},
+		{stat: "p101", err: true},
+		{stat: "p", err: true},
+		{stat: "pp99", err: true},
+		{stat: "x99", err: true},
+		{stat: "TM(:)", err: true},
+		{stat: "TM(10%:200%)", err: true},
+		{stat: "TM(a:b)", err: true},
+		{stat: "PR(10%:90%)", err: true},
+		{stat: "Avg", err: true},
+	} {
+		parsed, err := parseStat(tc.stat)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%q: expected error but got %q", tc.stat, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.stat, err)
+		}
+		if parsed != tc.parsed {
+			t.Fatalf("%q: expected %q but got %q", tc.stat, tc.parsed, parsed)
+		}
+		if suffix := statSuffix(parsed); suffix != tc.suffix {
+			t.Fatalf("%q: expected suffix %q but got %q", tc.stat, tc.suffix, suffix)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	taggingtypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stoewer/go-strcase"
+	"golang.org/x/sync/singleflight"
+)
+
+// resourceType describes how the metrics of a namespace refer to resources.
+type resourceType struct {
+	// Resource type filter of the Resource Groups Tagging API
+	filter string
+	// Dimension holding the resource ID
+	dimension string
+	// Prefix of the resource part of the ARN, followed by the resource ID
+	prefix string
+}
+
+// resourceTypes are the resource types by namespace.
+var resourceTypes = map[string]resourceType{
+	"AWS/ApplicationELB": {"elasticloadbalancing:loadbalancer", "LoadBalancer", "loadbalancer/"},
+	"AWS/AutoScaling":    {"autoscaling:autoScalingGroup", "AutoScalingGroupName", "autoScalingGroup:"},
+	"AWS/DynamoDB":       {"dynamodb:table", "TableName", "table/"},
+	"AWS/EBS":            {"ec2:volume", "VolumeId", "volume/"},
+	"AWS/EC2":            {"ec2:instance", "InstanceId", "instance/"},
+	"AWS/ElastiCache":    {"elasticache:cluster", "CacheClusterId", "cluster:"},
+	"AWS/ELB":            {"elasticloadbalancing:loadbalancer", "LoadBalancerName", "loadbalancer/"},
+	"AWS/Lambda":         {"lambda:function", "FunctionName", "function:"},
+	"AWS/NetworkELB":     {"elasticloadbalancing:loadbalancer", "LoadBalancer", "loadbalancer/"},
+	"AWS/RDS":            {"rds:db", "DBInstanceIdentifier", "db:"},
+	"AWS/S3":             {"s3", "BucketName", ""},
+	"AWS/SNS":            {"sns", "TopicName", ""},
+	"AWS/SQS":            {"sqs", "QueueName", ""},
+}
+
+// resourceID returns the ID of the resource with the given ARN as used in
+// CloudWatch dimensions.
+func (t resourceType) resourceID(resourceARN string) (string, bool) {
+	a, err := arn.Parse(resourceARN)
+	if err != nil || !strings.HasPrefix(a.Resource, t.prefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(a.Resource, t.prefix)
+	// Auto Scaling group ARNs have the form
+	// autoScalingGroup:<uuid>:autoScalingGroupName/<name>
+	if i := strings.Index(id, ":autoScalingGroupName/"); i >= 0 {
+		id = id[i+len(":autoScalingGroupName/"):]
+	}
+	return id, true
+}
+
+// tagLabelName returns the label name for a tag key.
+func tagLabelName(key string) string {
+	return "tag_" + strcase.SnakeCase(prometheusMetricNameRegexp.ReplaceAllString(key, "_"))
+}
+
+const (
+	// maxTagFilters is the maximum number of tag keys supported by
+	// GetResources.
+	maxTagFilters = 50
+	// tagLookupTimeout bounds looking up the resources of a namespace.
+	tagLookupTimeout = time.Minute
+)
+
+// tagFilter matches resources with the tag. If value is empty, all resources
+// having the tag match.
+type tagFilter struct {
+	key   string
+	value string
+}
+
+// parseTagFilters returns the tag filters for the given tag query parameter
+// values of the form Key=Value or Key.
+func parseTagFilters(values []string) ([]tagFilter, error) {
+	filters := make([]tagFilter, len(values))
+	for i, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q", value)
+		}
+		filters[i] = tagFilter{key: parts[0]}
+		if len(parts) == 2 {
+			filters[i].value = parts[1]
+		}
+	}
+	return filters, checkTagFilters(filters)
+}
+
+// checkTagFilters checks the number of tag keys filtered by.
+func checkTagFilters(filters []tagFilter) error {
+	keys := make(map[string]bool)
+	for _, f := range filters {
+		keys[f.key] = true
+	}
+	if len(keys) > maxTagFilters {
+		return fmt.Errorf("too many tags, got %d but at most %d are supported", len(keys), maxTagFilters)
+	}
+	return nil
+}
+
+// tagFiltersSupported returns whether the metrics of the namespace can be
+// filtered by the tags of their resources.
+func tagFiltersSupported(namespace string) bool {
+	_, ok := resourceTypes[namespace]
+	return ok || namespace == "*"
+}
+
+// validateTagFilters checks that the tag filters of the config can be
+// applied.
+func (c *reporterConfig) validateTagFilters() error {
+	if len(c.tagFilters) == 0 {
+		return nil
+	}
+	if c.insightsQuery != "" || c.search != "" {
+		return fmt.Errorf("tag filters are not supported with query or search")
+	}
+	if !tagFiltersSupported(c.namespace) {
+		return fmt.Errorf("tag filters are not supported for namespace %s", c.namespace)
+	}
+	return nil
+}
+
+// tagFiltersKey returns a key identifying the filters.
+func tagFiltersKey(filters []tagFilter) string {
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		parts[i] = f.key + "\x00" + f.value
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\xff")
+}
+
+// apiTagFilters returns the filters for the Resource Groups Tagging API.
+// Filters of the same key match any of their values.
+func apiTagFilters(filters []tagFilter) []taggingtypes.TagFilter {
+	var (
+		result = []taggingtypes.TagFilter{}
+		index  = make(map[string]int)
+		any    = make(map[string]bool)
+	)
+	for _, f := range filters {
+		i, ok := index[f.key]
+		if !ok {
+			i = len(result)
+			index[f.key] = i
+			result = append(result, taggingtypes.TagFilter{Key: aws.String(f.key)})
+		}
+		if f.value == "" {
+			any[f.key] = true
+			continue
+		}
+		result[i].Values = append(result[i].Values, f.value)
+	}
+	for key := range any {
+		result[index[key]].Values = nil
+	}
+	return result
+}
+
+// tagClient returns the tags of resources by namespace. Results are cached
+// for the TTL and concurrent lookups of the same resources share a single
+// lookup.
+type tagClient struct {
+	sync.Mutex
+	client  resourcegroupstaggingapi.GetResourcesAPIClient
+	ttl     time.Duration
+	entries map[string]*tagEntry
+	group   singleflight.Group
+}
+
+type tagEntry struct {
+	// Tags by resource ID
+	tags    map[string]map[string]string
+	updated time.Time
+}
+
+func newTagClient(client resourcegroupstaggingapi.GetResourcesAPIClient, ttl time.Duration) *tagClient {
+	return &tagClient{
+		client:  client,
+		ttl:     ttl,
+		entries: make(map[string]*tagEntry),
+	}
+}
+
+// resourceTags returns the tags of the resources of the namespace by
+// resource ID. Namespaces with unknown resource types have no tags.
+func (c *tagClient) resourceTags(ctx context.Context, namespace string) (map[string]map[string]string, error) {
+	return c.resources(ctx, namespace, nil)
+}
+
+// resources returns the tags of the resources of the namespace matching the
+// filters by resource ID.
+func (c *tagClient) resources(ctx context.Context, namespace string, filters []tagFilter) (map[string]map[string]string, error) {
+	rt, ok := resourceTypes[namespace]
+	if !ok {
+		return nil, nil
+	}
+	key := namespace + "\xff" + tagFiltersKey(filters)
+	c.Lock()
+	e, ok := c.entries[key]
+	c.Unlock()
+	if ok && time.Since(e.updated) < c.ttl {
+		return e.tags, nil
+	}
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		// The lookup is shared, so it must not be canceled with the
+		// context of any one caller.
+		ctx, cancel := context.WithTimeout(context.Background(), tagLookupTimeout)
+		defer cancel()
+		tags, err := c.getResources(ctx, rt, filters)
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		c.entries[key] = &tagEntry{tags: tags, updated: time.Now()}
+		c.Unlock()
+		return tags, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(map[string]map[string]string), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *tagClient) getResources(ctx context.Context, rt resourceType, filters []tagFilter) (map[string]map[string]string, error) {
+	var (
+		tags  = make(map[string]map[string]string)
+		input = &resourcegroupstaggingapi.GetResourcesInput{
+			ResourceTypeFilters: []string{rt.filter},
+		}
+	)
+	if len(filters) > 0 {
+		input.TagFilters = apiTagFilters(filters)
+	}
+	p := resourcegroupstaggingapi.NewGetResourcesPaginator(c.client, input)
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range out.ResourceTagMappingList {
+			id, ok := rt.resourceID(aws.ToString(r.ResourceARN))
+			if !ok {
+				continue
+			}
+			tags[id] = make(map[string]string, len(r.Tags))
+			for _, t := range r.Tags {
+				tags[id][aws.ToString(t.Key)] = aws.ToString(t.Value)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// metricResourceID returns the ID of the resource referenced by m or an
+// empty string if there is none.
+func metricResourceID(m *types.Metric) string {
+	rt, ok := resourceTypes[aws.ToString(m.Namespace)]
+	if !ok {
+		return ""
+	}
+	for _, d := range m.Dimensions {
+		if aws.ToString(d.Name) == rt.dimension {
+			return aws.ToString(d.Value)
+		}
+	}
+	return ""
+}
+
+// filterTagged returns the metrics referencing resources matching the tag
+// filters of the config.
+func (c *reporter) filterTagged(ctx context.Context, metrics []types.Metric) ([]types.Metric, error) {
+	if err := c.config.validateTagFilters(); err != nil {
+		return nil, err
+	}
+	var (
+		filtered = []types.Metric{}
+		// Matching resources by namespace
+		resources = make(map[string]map[string]map[string]string)
+	)
+	for i := range metrics {
+		id := metricResourceID(&metrics[i])
+		if id == "" {
+			continue
+		}
+		namespace := *metrics[i].Namespace
+		ids, ok := resources[namespace]
+		if !ok {
+			var err error
+			ids, err = c.tags.resources(ctx, namespace, c.config.tagFilters)
+			if err != nil {
+				return nil, err
+			}
+			resources[namespace] = ids
+		}
+		if _, ok := ids[id]; ok {
+			filtered = append(filtered, metrics[i])
+		}
+	}
+	return filtered, nil
+}
+
+// metricTags returns the allowed tags of the resource referenced by m, and
+// the resource ID.
+func (c *collector) metricTags(m *types.Metric) (map[string]string, string) {
+	id := metricResourceID(m)
+	if id == "" || c.reporter.tags == nil {
+		return nil, ""
+	}
+	return c.namespaceTags(*m.Namespace)[id], id
+}
+
+// namespaceTags returns the tags of the resources of the namespace by
+// resource ID. They are looked up once per scrape, so that not every series
+// causes a lookup if the tag cache is disabled. Failed lookups are logged and
+// result in no tags.
+func (c *collector) namespaceTags(namespace string) map[string]map[string]string {
+	c.resourceTagsLock.Lock()
+	tags, ok := c.resourceTags[namespace]
+	c.resourceTagsLock.Unlock()
+	if ok {
+		return tags
+	}
+	tags, err := c.reporter.tags.resourceTags(c.ctx, namespace)
+	if err != nil {
+		c.tagErrorOnce.Do(func() {
+			level.Error(c.logger).Log("msg", "failed to get resource tags", "namespace", namespace, "err", err)
+			c.errorCounter.Inc()
+		})
+	}
+	c.resourceTagsLock.Lock()
+	c.resourceTags[namespace] = tags
+	c.resourceTagsLock.Unlock()
+	return tags
+}
+
+// tagLabels appends a label for each allowed tag key to lns and lvs. Tags
+// missing on the resource have empty values.
+func (c *collector) tagLabels(lns, lvs []string, tags map[string]string) ([]string, []string) {
+	for _, key := range c.config.tagKeys {
+		lns, lvs = append(lns, tagLabelName(key)), append(lvs, tags[key])
+	}
+	return lns, lvs
+}
+
+// sendResourceInfo sends the aws_resource_info metric for the resource
+// referenced by m once per scrape.
+func (c *collector) sendResourceInfo(ch chan<- prometheus.Metric, m *types.Metric, ts time.Time) {
+	tags, id := c.metricTags(m)
+	if id == "" {
+		return
+	}
+	rt := resourceTypes[*m.Namespace]
+	c.resourceInfoLock.Lock()
+	key := *m.Namespace + "/" + id
+	sent := c.resourceInfoSent[key]
+	c.resourceInfoSent[key] = true
+	c.resourceInfoLock.Unlock()
+	if sent {
+		return
+	}
+	lns, lvs := c.tagLabels([]string{strcase.SnakeCase(rt.dimension)}, []string{id}, tags)
+	c.sendMetric(ch, "aws_resource_info", "Tags of AWS resources", lns, lvs, 1, ts)
+}
+
+// parseTagKeys returns the deduplicated tag keys from the given tag_key
+// query parameter values. Each value may be a comma separated list of keys.
+func parseTagKeys(values []string) ([]string, error) {
+	var (
+		keys   = []string{}
+		labels = make(map[string]string)
+	)
+	for _, value := range values {
+		for _, key := range strings.Split(value, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			ln := tagLabelName(key)
+			if k, ok := labels[ln]; ok {
+				if k == key {
+					continue
+				}
+				return nil, fmt.Errorf("tag keys %q and %q map to the same label %s", k, key, ln)
+			}
+			labels[ln] = key
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/cloudwatch-exporter/mock"
+
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestResourceID(t *testing.T) {
+	for _, tc := range []struct {
+		namespace string
+		arn       string
+		id        string
+		ok        bool
+	}{
+		{"AWS/EC2", "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123456789abcdef0", "i-0123456789abcdef0", true},
+		{"AWS/EC2", "arn:aws:ec2:eu-west-1:123456789012:volume/vol-0123456789abcdef0", "", false},
+		{"AWS/ApplicationELB", "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/web/50dc6c495c0c9188", "app/web/50dc6c495c0c9188", true},
+		{"AWS/RDS", "arn:aws:rds:eu-west-1:123456789012:db:orders", "orders", true},
+		{"AWS/SQS", "arn:aws:sqs:eu-west-1:123456789012:jobs", "jobs", true},
+		{"AWS/AutoScaling", "arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:8f2b5a1e-0c1d-4e2f-9a3b-4c5d6e7f8a9b:autoScalingGroupName/web-prod", "web-prod", true},
+		{"AWS/EC2", "i-0123456789abcdef0", "", false},
+	} {
+		id, ok := resourceTypes[tc.namespace].resourceID(tc.arn)
+		if id != tc.id || ok != tc.ok {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", tc.arn, tc.id, tc.ok, id, ok)
+		}
+	}
+}
+
+func TestParseTagKeys(t *testing.T) {
+	keys, err := parseTagKeys([]string{"Team, Environment", "Team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"Team", "Environment"}) {
+		t.Fatalf("Unexpected tag keys %v", keys)
+	}
+	if _, err := parseTagKeys([]string{"cost-center,cost_center"}); err == nil {
+		t.Fatal("Expected error for tag keys with the same label name")
+	}
+}
+
+func TestAPITagFilters(t *testing.T) {
+	filters, err := parseTagFilters([]string{"Environment=production", "Team", "Environment=staging", "Team=web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiFilters := apiTagFilters(filters)
+	if l := len(apiFilters); l != 2 {
+		t.Fatalf("Expected 2 filters but got %d", l)
+	}
+	if f := apiFilters[0]; *f.Key != "Environment" || !reflect.DeepEqual(f.Values, []string{"production", "staging"}) {
+		t.Fatalf("Unexpected filter %s %v", *f.Key, f.Values)
+	}
+	if f := apiFilters[1]; *f.Key != "Team" || len(f.Values) != 0 {
+		t.Fatalf("Expected filter matching any value but got %s %v", *f.Key, f.Values)
+	}
+	if _, err := parseTagFilters([]string{"=production"}); err == nil {
+		t.Fatal("Expected error for tag without key")
+	}
+}
+
+func TestTagClient(t *testing.T) {
+	client := mock.NewTaggingAPIClient()
+	client.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-a", map[string]string{"Team": "web"})
+	client.InsertResource("arn:aws:ec2:eu-west-1:123456789012:volume/vol-a", map[string]string{"Team": "web"})
+
+	c := newTagClient(client, time.Minute)
+	for i := 0; i < 2; i++ {
+		tags, err := c.resourceTags(context.Background(), "AWS/EC2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, map[string]map[string]string{"i-a": {"Team": "web"}}) {
+			t.Fatalf("Unexpected tags %v", tags)
+		}
+	}
+	if n := client.Calls(); n != 1 {
+		t.Fatalf("Expected 1 call but got %d", n)
+	}
+	if tags, err := c.resourceTags(context.Background(), "Custom/App"); err != nil || tags != nil {
+		t.Fatalf("Expected no tags for unknown namespace but got %v, %v", tags, err)
+	}
+
+	for _, e := range c.entries {
+		e.updated = time.Now().Add(-2 * time.Minute)
+	}
+	if _, err := c.resourceTags(context.Background(), "AWS/EC2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Calls(); n != 2 {
+		t.Fatalf("Expected expired entry to be refreshed but got %d calls", n)
+	}
+}
+
+// blockingTaggingClient blocks GetResources calls until released.
+type blockingTaggingClient struct {
+	*mock.TaggingAPIClient
+	started chan context.Context
+	release chan struct{}
+}
+
+func (c *blockingTaggingClient) GetResources(ctx context.Context, params *resourcegroupstaggingapi.GetResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.GetResourcesOutput, error) {
+	c.started <- ctx
+	<-c.release
+	return c.TaggingAPIClient.GetResources(ctx, params, optFns...)
+}
+
+func TestTagClientSharedLookup(t *testing.T) {
+	client := &blockingTaggingClient{
+		TaggingAPIClient: mock.NewTaggingAPIClient(),
+		started:          make(chan context.Context, 1),
+		release:          make(chan struct{}),
+	}
+	client.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-a", map[string]string{"Team": "web"})
+	c := newTagClient(client, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := c.resourceTags(ctx, "AWS/EC2")
+		errs <- err
+	}()
+	lookupCtx := <-client.started
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("Expected canceled caller but got %v", err)
+	}
+	if lookupCtx.Err() != nil {
+		t.Fatal("Expected the shared lookup not to be canceled with the caller")
+	}
+	close(client.release)
+	tags, err := c.resourceTags(context.Background(), "AWS/EC2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["i-a"]["Team"] != "web" {
+		t.Fatalf("Unexpected tags %v", tags)
+	}
+	if n := client.Calls(); n != 1 {
+		t.Fatalf("Expected 1 call but got %d", n)
+	}
+}
+
+func TestCollectorTags(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-a"})
+	client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-b"})
+	client.Insert("AWS/EC2", "NetworkIn", map[string]string{"InstanceId": "i-a"})
+	tagging := mock.NewTaggingAPIClient()
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-a", map[string]string{"Team": "web", "Owner": "alice"})
+
+	for _, tc := range []struct {
+		tagInfo bool
+		name    string
+		series  int
+	}{
+		{false, "aws_ec2_cpu_utilization_average", 2},
+		{true, "aws_resource_info", 2},
+	} {
+		config := newReporterConfig()
+		config.namespace = "AWS/EC2"
+		config.metricNames = []string{"*"}
+		config.stats = []string{"Average"}
+		config.tagKeys = []string{"Team", "Environment"}
+		config.tagInfo = tc.tagInfo
+		collector := newTestCollector(t, client, &config)
+		collector.tags = newTagClient(tagging, time.Minute)
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found *dto.MetricFamily
+		for _, mf := range mfs {
+			if mf.GetName() == tc.name {
+				found = mf
+			}
+			if tc.tagInfo && mf.GetName() != "aws_resource_info" && labelValue(mf.Metric[0], "tag_team") != "" {
+				t.Fatalf("Expected no tag labels on %s with tag_info", mf.GetName())
+			}
+		}
+		if found == nil {
+			t.Fatalf("Expected metric %s", tc.name)
+		}
+		if l := len(found.Metric); l != tc.series {
+			t.Fatalf("Expected %d series of %s but got %d", tc.series, tc.name, l)
+		}
+		for _, m := range found.Metric {
+			team := ""
+			if labelValue(m, "instance_id") == "i-a" {
+				team = "web"
+			}
+			if v := labelValue(m, "tag_team"); v != team {
+				t.Fatalf("%s: expected tag_team %q but got %q", tc.name, team, v)
+			}
+			if v := labelValue(m, "tag_owner"); v != "" {
+				t.Fatalf("%s: expected tag_owner not to be allowed but got %q", tc.name, v)
+			}
+		}
+	}
+}
+
+func TestCollectorTagsWithoutCache(t *testing.T) {
+	client := mock.NewCloudwatchAPIClient()
+	for i := 0; i < 10; i++ {
+		client.Insert("AWS/EC2", "CPUUtilization", map[string]string{"InstanceId": "i-" + strconv.Itoa(i)})
+	}
+	tagging := mock.NewTaggingAPIClient()
+	tagging.InsertResource("arn:aws:ec2:eu-west-1:123456789012:instance/i-1", map[string]string{"Team": "web"})
+
+	config := newReporterConfig()
+	config.namespace = "AWS/EC2"
+	config.metricNames = []string{"*"}
+	config.stats = []string{"Average", "Maximum"}
+	config.tagKeys = []string{"Team"}
+	config.tagInfo = true
+	tags := newTagClient(tagging, 0)
+
+	for scrape := 1; scrape <= 2; scrape++ {
+		collector := newTestCollector(t, client, &config)
+		collector.tags = tags
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+		if n := tagging.Calls(); n != scrape {
+			t.Fatalf("Expected %d GetResources calls after %d scrapes but got %d", scrape, scrape, n)
+		}
+	}
+}